@@ -8,13 +8,20 @@ import (
 	"log/slog"
 	"strings"
 	"sync"
+
+	"github.com/code-ointment/link-share/internal/config"
 )
 
 /*
 * Not a lot of options at present.
  */
 type Args struct {
-	LogLevel slog.Level
+	LogLevel   slog.Level
+	ConfigFile string
+	ConfigSet  bool   // -config given explicitly
+	Role       string // overrides the config file when set
+	DryRun     bool
+	Command    []string // subcommand and its arguments, e.g. key generate
 }
 
 var cmdLineArgs *Args
@@ -36,20 +43,56 @@ func (a *Args) init() {
 	var levelStr string
 
 	flag.StringVar(&levelStr, "log", "INFO", "logging level [ DEBUG,INFO,WARN ]")
+	flag.StringVar(&a.ConfigFile, "config", config.DefaultPath,
+		"configuration file")
+	flag.StringVar(&a.Role, "role", "",
+		"gateway, client or auto.  Overrides the configuration file")
+	flag.BoolVar(&a.DryRun, "dry-run", false,
+		"log routing, firewall and DNS changes instead of making them")
 
 	flag.Parse()
 	a.LogLevel = a.parseLevel(levelStr)
+	a.Role = strings.ToLower(a.Role)
+	a.Command = flag.Args()
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			a.ConfigSet = true
+		}
+	})
 }
 
 func (a *Args) parseLevel(levelStr string) slog.Level {
 
+	level, ok := lookupLevel(levelStr)
+	if !ok {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+func lookupLevel(levelStr string) (slog.Level, bool) {
+
 	switch strings.ToUpper(levelStr) {
 	case "INFO":
-		return slog.LevelInfo
+		return slog.LevelInfo, true
 	case "DEBUG":
-		return slog.LevelDebug
+		return slog.LevelDebug, true
 	case "WARN":
-		return slog.LevelWarn
+		return slog.LevelWarn, true
+	}
+	return slog.LevelInfo, false
+}
+
+/*
+* Command line settings that take precedence over the configuration file.
+ */
+func (a *Args) configOverrides(c *config.Config) {
+
+	if a.Role != "" {
+		c.Role = a.Role
+	}
+	if a.DryRun {
+		c.DryRun = true
 	}
-	return slog.LevelInfo
 }
@@ -0,0 +1,56 @@
+package main
+
+/*
+* Glue between the control socket and the daemon.  Most requests go
+* straight to the engine, logging belongs to main.
+ */
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+
+	"github.com/code-ointment/link-share/internal/control"
+	"github.com/code-ointment/link-share/internal/engine"
+)
+
+type controlBackend struct {
+	eng *engine.ProtocolEngine
+}
+
+func (cb *controlBackend) Status() *control.Status {
+	return cb.eng.Status()
+}
+
+func (cb *controlBackend) Resync() error {
+	return cb.eng.Resync()
+}
+
+func (cb *controlBackend) Withdraw() error {
+	return cb.eng.Withdraw()
+}
+
+func (cb *controlBackend) SetLogLevel(level string) error {
+
+	l, ok := lookupLevel(level)
+	if !ok {
+		return fmt.Errorf("unknown log level %q, use DEBUG, INFO or WARN", level)
+	}
+	slog.Info("log level changed", "level", l)
+	logLevel.Set(l)
+	return nil
+}
+
+/*
+* Same path as SIGTERM so shutdown happens in one place.  The reply goes out
+* before the signal is handled.
+ */
+func (cb *controlBackend) Stop() error {
+
+	slog.Info("stop requested")
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		return err
+	}
+	return p.Signal(syscall.SIGTERM)
+}
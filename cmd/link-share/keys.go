@@ -0,0 +1,127 @@
+package main
+
+/*
+* 'link-share key ...' subcommands.  Manage the gateway signing identity and
+* the clients' pinned gateway keys, and create pre-shared keys.
+ */
+import (
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/auth"
+	"github.com/code-ointment/link-share/internal/config"
+)
+
+const keyUsage = `usage: link-share [-config file] key command
+
+commands:
+  generate [-force]        create the gateway signing identity
+  show                     print the identity's public key and fingerprint
+  trust GATEWAY PUBKEY     pin a gateway's public key
+  revoke GATEWAY           forget a gateway's pinned key
+  list                     show pinned gateway keys
+  psk                      print a new random pre-shared key secret
+`
+
+/*
+* Run a key subcommand, returning the process exit code.
+ */
+func keyCommand(params []string) int {
+
+	if len(params) == 0 {
+		fmt.Fprint(os.Stderr, keyUsage)
+		return 2
+	}
+
+	if err := runKeyCommand(params[0], params[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "link-share key %s: %v\n", params[0], err)
+		return 1
+	}
+	return 0
+}
+
+func runKeyCommand(cmd string, params []string) error {
+
+	signing := config.Get().Security.Signing
+
+	switch cmd {
+
+	case "generate":
+		force := len(params) == 1 && (params[0] == "-force" || params[0] == "--force")
+		id, err := auth.GenerateIdentity(signing.KeyFile, force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s\n", signing.KeyFile)
+		printIdentity(id)
+		return nil
+
+	case "show":
+		id, err := auth.LoadIdentity(signing.KeyFile)
+		if err != nil {
+			return err
+		}
+		printIdentity(id)
+		return nil
+
+	case "trust":
+		if len(params) != 2 {
+			return fmt.Errorf("expected GATEWAY PUBKEY")
+		}
+		if net.ParseIP(params[0]) == nil {
+			return fmt.Errorf("%q is not an IP address", params[0])
+		}
+		pub, err := auth.DecodePublicKey(params[1])
+		if err != nil {
+			return fmt.Errorf("bad public key: %w", err)
+		}
+		ts := auth.NewTrustStore(signing.TrustStore)
+		if err := ts.Trust(params[0], pub); err != nil {
+			return err
+		}
+		fmt.Printf("trusted %s %s\n", params[0], auth.Fingerprint(pub))
+		return nil
+
+	case "revoke":
+		if len(params) != 1 {
+			return fmt.Errorf("expected GATEWAY")
+		}
+		ts := auth.NewTrustStore(signing.TrustStore)
+		if err := ts.Revoke(params[0]); err != nil {
+			return err
+		}
+		fmt.Printf("revoked %s\n", params[0])
+		return nil
+
+	case "list":
+		ts := auth.NewTrustStore(signing.TrustStore)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "GATEWAY\tFINGERPRINT\tSOURCE\tADDED")
+		for _, e := range ts.List() {
+			added := time.Unix(e.Added, 0).Format(time.DateTime)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Gateway, e.Fingerprint,
+				e.Source, added)
+		}
+		tw.Flush()
+		return nil
+
+	case "psk":
+		secret, err := auth.GenerateSecret()
+		if err != nil {
+			return err
+		}
+		fmt.Println(secret)
+		return nil
+	}
+
+	fmt.Fprint(os.Stderr, keyUsage)
+	return fmt.Errorf("unknown command")
+}
+
+func printIdentity(id *auth.Identity) {
+	fmt.Printf("public key:  %s\n", auth.EncodePublicKey(id.PublicKey()))
+	fmt.Printf("fingerprint: %s\n", id.Fingerprint())
+}
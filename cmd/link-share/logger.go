@@ -7,16 +7,20 @@ import (
 	"github.com/code-ointment/log-writer/logfile"
 )
 
+// Adjustable at run time through the control socket.
+var logLevel slog.LevelVar
+
 /*
 * Configure log at module load time.
  */
 func init() {
 
 	args := GetArgs()
+	logLevel.Set(args.LogLevel)
 
 	opts := slog.HandlerOptions{
 		AddSource: true,
-		Level:     args.LogLevel,
+		Level:     &logLevel,
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
 			if a.Key == slog.SourceKey {
 				src, _ := a.Value.Any().(*slog.Source)
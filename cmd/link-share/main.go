@@ -9,7 +9,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/code-ointment/link-share/internal/config"
 	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/control"
 	"github.com/code-ointment/link-share/internal/engine"
 	logwriter "github.com/code-ointment/log-writer"
 )
@@ -82,23 +84,53 @@ func sigQuitHandler() {
 func heloThread(eng *engine.ProtocolEngine) {
 	for {
 		eng.SendHelo()
-		eng.HostAccounting()
-		time.Sleep(time.Duration(consts.POLL_INTERVAL) * time.Second)
+		time.Sleep(eng.HeloInterval())
 	}
 }
 
 func main() {
 
+	args := GetArgs()
+	if err := config.Load(args.ConfigFile, args.ConfigSet,
+		args.configOverrides); err != nil {
+		slog.Error("invalid configuration", "error", err)
+		fmt.Fprintf(os.Stderr, "link-share: %v\n", err)
+		logwriter.Flush()
+		os.Exit(1)
+	}
+
+	if len(args.Command) > 0 {
+		code := 2
+		switch args.Command[0] {
+		case "key":
+			code = keyCommand(args.Command[1:])
+		case "version":
+			fmt.Println(consts.Version)
+			code = 0
+		default:
+			fmt.Fprintf(os.Stderr, "link-share: unknown command %q\n",
+				args.Command[0])
+		}
+		logwriter.Flush()
+		os.Exit(code)
+	}
+
 	go sigQuitHandler()
 
 	eng = engine.NewProtocolEngine()
 	eng.Start()
 
+	ctl := control.NewServer(control.DefaultSocket, &controlBackend{eng: eng})
+	if err := ctl.Start(); err != nil {
+		slog.Error("control socket unavailable", "error", err)
+	}
+
 	go heloThread(eng)
 	recordPid()
 
 	sigWaitHandler()
 
+	ctl.Stop()
 	eng.Shutdown()
 	os.Exit(0)
 }
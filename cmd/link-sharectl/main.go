@@ -0,0 +1,125 @@
+package main
+
+/*
+* Command line client for the link-share control socket.
+ */
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/code-ointment/link-share/internal/control"
+)
+
+const usage = `usage: link-sharectl [-json] [-socket path] command
+
+commands:
+  status            everything the daemon knows
+  peers             hosts heard from on the link
+  routes            learned and installed routes
+  dns               applied DNS configuration
+  resync            re-advertise or request routes again
+  withdraw          withdraw shared or installed routes until resync
+  log-level LEVEL   DEBUG, INFO or WARN
+  stop              stop the daemon
+`
+
+type options struct {
+	json   bool
+	socket string
+}
+
+func main() {
+
+	opts := options{}
+	fs := flag.NewFlagSet("link-sharectl", flag.ExitOnError)
+	fs.BoolVar(&opts.json, "json", false, "print raw JSON instead of tables")
+	fs.StringVar(&opts.socket, "socket", control.DefaultSocket, "control socket")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+
+	// Flags may appear before or after the command.
+	fs.Parse(os.Args[1:])
+	rest := fs.Args()
+	if len(rest) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd := rest[0]
+	fs.Parse(rest[1:])
+	params := fs.Args()
+
+	client := control.NewClient(opts.socket)
+	if err := run(client, &opts, cmd, params); err != nil {
+		fmt.Fprintf(os.Stderr, "link-sharectl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(client *control.Client, opts *options, cmd string, params []string) error {
+
+	switch cmd {
+
+	case control.CmdStatus:
+		st := control.Status{}
+		if err := client.Call(cmd, nil, &st); err != nil {
+			return err
+		}
+		return show(opts, &st, func() { printStatus(&st) })
+
+	case control.CmdPeers:
+		peers := []control.Peer{}
+		if err := client.Call(cmd, nil, &peers); err != nil {
+			return err
+		}
+		return show(opts, peers, func() { printPeers(peers) })
+
+	case control.CmdRoutes:
+		routes := control.RouteInfo{}
+		if err := client.Call(cmd, nil, &routes); err != nil {
+			return err
+		}
+		return show(opts, &routes, func() { printRoutes(&routes) })
+
+	case control.CmdDns:
+		dns := control.DnsState{}
+		if err := client.Call(cmd, nil, &dns); err != nil {
+			return err
+		}
+		return show(opts, &dns, func() { printDns(&dns) })
+
+	case control.CmdResync, control.CmdWithdraw, control.CmdStop:
+		if err := client.Call(cmd, nil, nil); err != nil {
+			return err
+		}
+		return show(opts, map[string]bool{"ok": true}, func() { fmt.Println("ok") })
+
+	case control.CmdLogLevel:
+		if len(params) != 1 {
+			return fmt.Errorf("log-level takes one argument, DEBUG, INFO or WARN")
+		}
+		args := map[string]string{"level": params[0]}
+		if err := client.Call(cmd, args, nil); err != nil {
+			return err
+		}
+		return show(opts, map[string]bool{"ok": true}, func() { fmt.Println("ok") })
+	}
+
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+/*
+* JSON for scripts, a table for people.
+ */
+func show(opts *options, v any, table func()) error {
+
+	if !opts.json {
+		table()
+		return nil
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,238 @@
+package main
+
+/*
+* Human readable renderings of control API results.
+ */
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/control"
+)
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+/*
+* Time left until a unix time, "-" for none.
+ */
+func expiresIn(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	left := time.Until(time.Unix(t, 0)).Round(time.Second)
+	if left < 0 {
+		return "expired"
+	}
+	return "in " + left.String()
+}
+
+/*
+* Time since a unix time, "-" for none.
+ */
+func uptime(started int64) string {
+	if started == 0 {
+		return "-"
+	}
+	return time.Since(time.Unix(started, 0)).Round(time.Second).String()
+}
+
+/*
+* Enough of a node id to tell nodes apart.
+ */
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+func millis(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).String()
+}
+
+func numOrDash(n uint64) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func printStatus(st *control.Status) {
+
+	tw := newTable()
+	fmt.Fprintf(tw, "Node:\t%s %s\n", st.Hostname, st.NodeID)
+	fmt.Fprintf(tw, "Version:\t%s, up %s\n", st.Version, uptime(st.Started))
+	fmt.Fprintf(tw, "Domain:\t%s, %d packets from other domains ignored\n",
+		st.Domain, st.Foreign)
+	fmt.Fprintf(tw, "Role:\t%s (%s)\n", st.Role, st.ActiveRole)
+	fmt.Fprintf(tw, "Configured:\t%t\n", st.Configured)
+	if st.Withdrawn {
+		fmt.Fprintf(tw, "Withdrawn:\t%t, until resync\n", st.Withdrawn)
+	}
+	if st.Generation > 0 {
+		fmt.Fprintf(tw, "Generation:\t%d\n", st.Generation)
+	}
+	if st.Priority > 0 {
+		fmt.Fprintf(tw, "Priority:\t%d\n", st.Priority)
+	}
+	if st.FastHelo > 0 {
+		fmt.Fprintf(tw, "Fast helos:\tevery %s\n", millis(st.FastHelo))
+	}
+	if st.DryRun {
+		fmt.Fprintf(tw, "Dry run:\t%t\n", st.DryRun)
+	}
+	for _, l := range st.Links {
+		fmt.Fprintf(tw, "Link:\t%s %s %s\n", l.Name, l.Transport, l.Group)
+	}
+	fmt.Fprintf(tw, "Routing:\t%t\n", st.Nft.RoutingEnabled)
+	fmt.Fprintf(tw, "Nftables:\t%s %s\n", orDash(st.Nft.Link),
+		orDash(strings.Join(st.Nft.Tables, ", ")))
+	fmt.Fprintf(tw, "Pre-shared key:\t%s\n", pskSummary(&st.Security))
+	fmt.Fprintf(tw, "Rejected packets:\t%d failed authentication, %d unauthenticated, %d signature, %d replay\n",
+		st.Security.AuthFailures, st.Security.Unauthenticated,
+		st.Security.SignatureRejects, st.Security.ReplayRejects)
+	fmt.Fprintf(tw, "Signing identity:\t%s\n", orDash(st.Security.Identity))
+	if st.Health != nil {
+		fmt.Fprintf(tw, "Tunnel health:\t%s, on failure %s\n", st.Health.State,
+			st.Health.OnFailure)
+	}
+	tw.Flush()
+
+	if st.Health != nil {
+		fmt.Println()
+		printProbes(st.Health.Probes)
+	}
+
+	if len(st.Security.Pinned) > 0 {
+		fmt.Println()
+		tw = newTable()
+		fmt.Fprintln(tw, "PINNED GATEWAY\tFINGERPRINT\tSOURCE")
+		for _, p := range st.Security.Pinned {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Gateway, p.Fingerprint, p.Source)
+		}
+		tw.Flush()
+	}
+
+	fmt.Println()
+	printPeers(st.Peers)
+	fmt.Println()
+	printRoutes(&st.Routes)
+	fmt.Println()
+	printDns(&st.Dns)
+}
+
+func printProbes(probes []control.ProbeResult) {
+
+	tw := newTable()
+	fmt.Fprintln(tw, "PROBE\tTARGET\tRESULT\tRTT\tFAILURES\tCHECKED")
+	for _, p := range probes {
+		result := "ok"
+		rtt := fmt.Sprintf("%.1fms", p.Rtt)
+		if !p.Ok {
+			result = orDash(p.Error)
+			rtt = "-"
+		}
+		checked := "-"
+		if p.Checked != 0 {
+			checked = uptime(p.Checked) + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", p.Type, p.Target,
+			result, rtt, p.Failures, checked)
+	}
+	tw.Flush()
+}
+
+func pskSummary(sec *control.Security) string {
+
+	if !sec.PskEnabled {
+		return "off"
+	}
+	return fmt.Sprintf("sending with key %d, accepting %v", sec.SendKey, sec.Keys)
+}
+
+func printPeers(peers []control.Peer) {
+
+	tw := newTable()
+	fmt.Fprintln(tw, "PEER\tNODE\tADDRESS\tROLE\tVERSION\tSTATE\tHEALTH\tPRIORITY\tGENERATION\tUPTIME\tDEAD AFTER\tLAST SEEN")
+	for _, p := range peers {
+		seen := time.Since(time.Unix(p.LastSeen, 0)).Round(time.Second)
+		name := p.Hostname
+		if name == "" {
+			name = p.ID
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s ago\n",
+			name, shortID(p.ID), orDash(p.Address), orDash(p.Role),
+			orDash(p.Version), p.State, orDash(p.Health),
+			numOrDash(uint64(p.Priority)), numOrDash(p.Generation),
+			uptime(p.Started), millis(p.DeadAfter), seen)
+	}
+	tw.Flush()
+}
+
+func printRoutes(routes *control.RouteInfo) {
+
+	tw := newTable()
+	fmt.Fprintln(tw, "LEARNED\tOP\tIFNAME")
+	for _, r := range routes.Learned {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Dest, r.Op, orDash(r.Ifname))
+	}
+	tw.Flush()
+
+	if len(routes.Dampened) > 0 {
+		fmt.Println()
+		tw = newTable()
+		fmt.Fprintln(tw, "FLAPPED\tSTATE\tFLAPS\tPENALTY")
+		for _, d := range routes.Dampened {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", d.Dest, d.State, d.Flaps,
+				d.Penalty)
+		}
+		tw.Flush()
+	}
+
+	fmt.Println()
+	tw = newTable()
+	fmt.Fprintln(tw, "INSTALLED\tGATEWAY\tIFNAME\tOWNER\tEXPIRES\tSTANDBY")
+	for _, r := range routes.Installed {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Dest, orDash(r.Gateway),
+			orDash(r.Ifname), orDash(r.Owner), expiresIn(r.Expires),
+			orDash(strings.Join(r.Standby, ", ")))
+
+		// Multipath routes list their next hops underneath.
+		for _, h := range r.Hops {
+			fmt.Fprintf(tw, "  nexthop\t%s\t\t%s\t\tweight %d\n", h.Gateway,
+				h.Owner, h.Weight)
+		}
+	}
+	tw.Flush()
+}
+
+func printDns(dns *control.DnsState) {
+
+	tw := newTable()
+	fmt.Fprintf(tw, "DNS backend:\t%s\n", dns.Backend)
+	fmt.Fprintf(tw, "Link:\t%s\n", orDash(dns.Link))
+	fmt.Fprintf(tw, "Nameservers:\t%s\n", orDash(dns.Nameservers))
+	fmt.Fprintf(tw, "Search domains:\t%s\n", orDash(dns.Searchdomains))
+	fmt.Fprintf(tw, "Announced config applied:\t%t\n", dns.BackedUp)
+	fmt.Fprintf(tw, "From gateway:\t%s\n", orDash(dns.Owner))
+	if dns.Settling {
+		fmt.Fprintf(tw, "Change settling:\t%t\n", dns.Settling)
+	}
+	for _, r := range dns.Routes {
+		fmt.Fprintf(tw, "Routing domains:\t%s via %s\n",
+			strings.Join(r.Domains, " "), strings.Join(r.Nameservers, " "))
+	}
+	tw.Flush()
+}
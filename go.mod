@@ -3,15 +3,16 @@ module github.com/code-ointment/link-share
 go 1.22.5
 
 require (
+	github.com/code-ointment/log-writer v0.0.0-20250123225921-5fa678947fd2
 	github.com/google/nftables v0.2.0
 	github.com/vishvananda/netlink v1.3.0
 	golang.org/x/net v0.34.0
 	golang.org/x/sys v0.29.0
 	google.golang.org/protobuf v1.36.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/code-ointment/log-writer v0.0.0-20250123225921-5fa678947fd2 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/josharian/native v1.1.0 // indirect
 	github.com/mdlayher/netlink v1.7.2 // indirect
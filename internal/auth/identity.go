@@ -0,0 +1,129 @@
+package auth
+
+/*
+* Ed25519 identity a gateway signs its announcements with.  Stored as a PKCS8
+* PEM file readable by root only.
+ */
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type Identity struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+/*
+* Create a new identity and write it to path.  An existing file is only
+* replaced when force is set.
+ */
+func GenerateIdentity(path string, force bool) (*Identity, error) {
+
+	if _, err := os.Stat(path); err == nil && !force {
+		return nil, fmt.Errorf("%s exists, refusing to overwrite", path)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+
+	id := Identity{private: priv, public: pub}
+	return &id, nil
+}
+
+func LoadIdentity(path string) (*Identity, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PRIVATE KEY block", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+
+	id := Identity{private: priv, public: priv.Public().(ed25519.PublicKey)}
+	return &id, nil
+}
+
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.public
+}
+
+func (id *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(id.private, msg)
+}
+
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.public)
+}
+
+/*
+* ssh style SHA256 fingerprint.
+ */
+func Fingerprint(pub ed25519.PublicKey) string {
+
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+func DecodePublicKey(s string) (ed25519.PublicKey, error) {
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("wrong public key size")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+/*
+* Check a signature made by pub.
+ */
+func Verify(pub []byte, msg []byte, sig []byte) bool {
+
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), msg, sig)
+}
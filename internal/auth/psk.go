@@ -0,0 +1,177 @@
+package auth
+
+/*
+* Pre-shared key protection of protocol packets.  Every configured key is
+* accepted on receive, the send key seals outgoing packets.  Rotating keys
+* means adding the new key everywhere, switching send_key, then removing the
+* old key.
+*
+* Secrets are at least 32 random bytes, base64 encoded, and the AES-256 key
+* is derived from them with HKDF-SHA256 (RFC 5869).
+ */
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown key id")
+	ErrBadPacket  = errors.New("authentication failed")
+)
+
+// Random bytes a secret must hold.
+const MinSecretBytes = 32
+
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	sendID uint32
+}
+
+/*
+* Decode a base64 secret, refusing ones too short to be a key.
+ */
+func DecodeSecret(secret string) ([]byte, error) {
+
+	b, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, errors.New("secret is not base64")
+	}
+	if len(b) < MinSecretBytes {
+		return nil, fmt.Errorf("secret holds %d bytes, at least %d required",
+			len(b), MinSecretBytes)
+	}
+	return b, nil
+}
+
+/*
+* A new random secret, for 'link-share key psk'.
+ */
+func GenerateSecret() (string, error) {
+
+	b := make([]byte, MinSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+/*
+* HKDF-SHA256 extract and expand, one block being all an AES-256 key needs.
+ */
+func deriveKey(secret []byte, info string) []byte {
+
+	extract := hmac.New(sha256.New, []byte("link-share psk"))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+/*
+* Build the keyring, deriving an AES-256 key from each secret.
+ */
+func NewKeyring(secrets map[uint32]string, sendID uint32) (*Keyring, error) {
+
+	kr := Keyring{
+		keys:   map[uint32]cipher.AEAD{},
+		sendID: sendID,
+	}
+
+	for id, secret := range secrets {
+		b, err := DecodeSecret(secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		key := deriveKey(b, "link-share packet key")
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+	}
+
+	if _, ok := kr.keys[sendID]; !ok {
+		return nil, fmt.Errorf("send key %d is not configured", sendID)
+	}
+	return &kr, nil
+}
+
+func (kr *Keyring) SendKeyID() uint32 {
+	return kr.sendID
+}
+
+func (kr *Keyring) KeyIDs() []uint32 {
+
+	ids := []uint32{}
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+/*
+* Key id is bound in as additional data so a packet can't be relabelled.
+ */
+func additionalData(id uint32) []byte {
+
+	ad := []byte("link-share\x00\x00\x00\x00")
+	binary.BigEndian.PutUint32(ad[len(ad)-4:], id)
+	return ad
+}
+
+/*
+* Encrypt a marshaled packet with the send key.
+ */
+func (kr *Keyring) Seal(plain []byte) (*link_proto.Sealed, error) {
+
+	aead := kr.keys[kr.sendID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	s := link_proto.Sealed{
+		KeyId:      kr.sendID,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plain, additionalData(kr.sendID)),
+	}
+	return &s, nil
+}
+
+/*
+* Verify and decrypt, returning the marshaled inner packet.
+ */
+func (kr *Keyring) Open(s *link_proto.Sealed) ([]byte, error) {
+
+	aead, ok := kr.keys[s.GetKeyId()]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, s.GetKeyId())
+	}
+
+	if len(s.GetNonce()) != aead.NonceSize() {
+		return nil, ErrBadPacket
+	}
+
+	plain, err := aead.Open(nil, s.GetNonce(), s.GetCiphertext(),
+		additionalData(s.GetKeyId()))
+	if err != nil {
+		return nil, ErrBadPacket
+	}
+	return plain, nil
+}
@@ -0,0 +1,220 @@
+package auth
+
+/*
+* Gateway keys a client trusts, pinned by gateway address.  Entries come from
+* trust on first use or are provisioned with 'link-share key trust'.  The
+* file is re-read when it changes so the key subcommands take effect on a
+* running daemon.
+ */
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SourceTofu   string = "tofu"
+	SourceManual string = "manual"
+)
+
+var (
+	ErrKeyMismatch = errors.New("gateway key does not match pinned key")
+	ErrUntrusted   = errors.New("gateway key not trusted")
+)
+
+type TrustEntry struct {
+	Gateway     string `json:"gateway"`
+	Key         string `json:"key"` // base64 Ed25519 public key
+	Fingerprint string `json:"fingerprint"`
+	Source      string `json:"source"`
+	Added       int64  `json:"added"` // unix seconds
+}
+
+type TrustStore struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]*TrustEntry
+	modTime time.Time
+}
+
+func NewTrustStore(path string) *TrustStore {
+
+	ts := TrustStore{
+		path:    path,
+		entries: map[string]*TrustEntry{},
+	}
+	ts.reload()
+	return &ts
+}
+
+/*
+* Pick up changes made by another process.
+ */
+func (ts *TrustStore) reload() {
+
+	st, err := os.Stat(ts.path)
+	if err != nil {
+		if len(ts.entries) > 0 {
+			slog.Warn("trust store removed", "path", ts.path)
+		}
+		ts.entries = map[string]*TrustEntry{}
+		ts.modTime = time.Time{}
+		return
+	}
+	if st.ModTime().Equal(ts.modTime) {
+		return
+	}
+
+	b, err := os.ReadFile(ts.path)
+	if err != nil {
+		slog.Warn("error reading trust store", "path", ts.path, "error", err)
+		return
+	}
+
+	list := []*TrustEntry{}
+	if err := json.Unmarshal(b, &list); err != nil {
+		slog.Warn("error parsing trust store", "path", ts.path, "error", err)
+		return
+	}
+
+	ts.entries = map[string]*TrustEntry{}
+	for _, e := range list {
+		ts.entries[e.Gateway] = e
+	}
+	ts.modTime = st.ModTime()
+}
+
+func (ts *TrustStore) save() error {
+
+	list := ts.list()
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ts.path), 0700); err != nil {
+		return err
+	}
+	tmp := ts.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ts.path); err != nil {
+		return err
+	}
+
+	if st, err := os.Stat(ts.path); err == nil {
+		ts.modTime = st.ModTime()
+	}
+	return nil
+}
+
+func (ts *TrustStore) list() []TrustEntry {
+
+	list := []TrustEntry{}
+	for _, e := range ts.entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Gateway < list[j].Gateway
+	})
+	return list
+}
+
+func (ts *TrustStore) List() []TrustEntry {
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.reload()
+	return ts.list()
+}
+
+/*
+* Decide whether pub may speak for gateway.  Unknown gateways are pinned
+* when tofu is set.
+ */
+func (ts *TrustStore) Check(gateway string, pub ed25519.PublicKey,
+	tofu bool) error {
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.reload()
+	key := EncodePublicKey(pub)
+
+	if e, ok := ts.entries[gateway]; ok {
+		if e.Key != key {
+			return fmt.Errorf("%w: pinned %s, got %s", ErrKeyMismatch,
+				e.Fingerprint, Fingerprint(pub))
+		}
+		return nil
+	}
+
+	if !tofu {
+		return fmt.Errorf("%w: %s", ErrUntrusted, Fingerprint(pub))
+	}
+
+	ts.entries[gateway] = &TrustEntry{
+		Gateway:     gateway,
+		Key:         key,
+		Fingerprint: Fingerprint(pub),
+		Source:      SourceTofu,
+		Added:       time.Now().Unix(),
+	}
+	slog.Warn("trusting new gateway key on first use",
+		"gateway", gateway, "fingerprint", Fingerprint(pub))
+	return ts.save()
+}
+
+/*
+* Is any key pinned for the gateway?
+ */
+func (ts *TrustStore) IsPinned(gateway string) bool {
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.reload()
+	_, ok := ts.entries[gateway]
+	return ok
+}
+
+/*
+* Pin a key by hand, replacing whatever was there.
+ */
+func (ts *TrustStore) Trust(gateway string, pub ed25519.PublicKey) error {
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.reload()
+	ts.entries[gateway] = &TrustEntry{
+		Gateway:     gateway,
+		Key:         EncodePublicKey(pub),
+		Fingerprint: Fingerprint(pub),
+		Source:      SourceManual,
+		Added:       time.Now().Unix(),
+	}
+	return ts.save()
+}
+
+func (ts *TrustStore) Revoke(gateway string) error {
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.reload()
+	if _, ok := ts.entries[gateway]; !ok {
+		return fmt.Errorf("no key pinned for %s", gateway)
+	}
+	delete(ts.entries, gateway)
+	return ts.save()
+}
@@ -0,0 +1,783 @@
+package config
+
+/*
+* Runtime configuration.  Values not present in the file keep the defaults
+* defined in internal/consts, so an empty or missing file behaves exactly
+* like the compiled in settings.
+ */
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/auth"
+	"github.com/code-ointment/link-share/internal/consts"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultPath   string = "/etc/link-share/link-share.yaml"
+	DefaultDomain string = "default"
+)
+
+type Config struct {
+	PollInterval    time.Duration `yaml:"poll_interval"`
+	GroupAddr       string        `yaml:"group_addr"`
+	GroupAddr4      string        `yaml:"group_addr4"`
+	Transport       string        `yaml:"transport"` // ipv6, ipv4 or auto
+	NodeIDFile      string        `yaml:"node_id_file"`
+	ListenPort      int           `yaml:"listen_port"`
+	MaxDatagramSize int           `yaml:"max_datagram_size"`
+	Domain          string        `yaml:"domain"`  // sharing domain
+	Role            string        `yaml:"role"`    // gateway, client or auto
+	DryRun          bool          `yaml:"dry_run"` // log system changes, don't make them
+
+	Interfaces Interfaces `yaml:"interfaces"`
+	Tunnels    Tunnels    `yaml:"tunnels"`
+	Dns        Dns        `yaml:"dns"`
+	Prefixes   Prefixes   `yaml:"prefixes"`
+	Security   Security   `yaml:"security"`
+	Peers      Peers      `yaml:"peers"`
+	Election   Election   `yaml:"election"`
+	Multipath  Multipath  `yaml:"multipath"`
+	Leases     Leases     `yaml:"leases"`
+	Mtu        Mtu        `yaml:"mtu"`
+	Health     Health     `yaml:"health"`
+	Hello      Hello      `yaml:"hello"`
+	Dampening  Dampening  `yaml:"dampening"`
+}
+
+/*
+* Interfaces whose name starts with one of these are never used.
+ */
+type Interfaces struct {
+	Exclude []string `yaml:"exclude"`
+}
+
+/*
+* Point to point links whose name contains one of these are treated as VPN
+* tunnels.
+ */
+type Tunnels struct {
+	Patterns []string `yaml:"patterns"`
+}
+
+type Dns struct {
+	Advertise bool     `yaml:"advertise"` // gateway sends its DNS settings
+	Apply     bool     `yaml:"apply"`     // client adopts announced DNS settings
+	Split     bool     `yaml:"split"`     // client uses them for the routing domains only
+	Domains   []string `yaml:"domains"`   // gateway routing domains, its search domains if empty
+
+	// Client waits for announced settings to stay the same this long.
+	Settle time.Duration `yaml:"settle"`
+}
+
+/*
+* Prefix filters.  An empty include list means everything is included,
+* exclude always wins.
+ */
+type Prefixes struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+
+	include []*net.IPNet
+	exclude []*net.IPNet
+}
+
+/*
+* Packet protection.  With no keys packets travel in the clear.  Once a key
+* is configured unprotected packets are rejected.
+ */
+type Security struct {
+	Keys         []Psk         `yaml:"keys"`
+	SendKey      uint32        `yaml:"send_key"` // may be omitted with a single key
+	Signing      Signing       `yaml:"signing"`
+	MaxPacketAge time.Duration `yaml:"max_packet_age"` // 0 turns off the check
+}
+
+/*
+* Gateways sign announcements when key_file exists.  Clients pin gateway
+* keys in trust_store, on first use when tofu is set.
+ */
+type Signing struct {
+	KeyFile    string `yaml:"key_file"`
+	TrustStore string `yaml:"trust_store"`
+	Tofu       bool   `yaml:"tofu"`
+	Require    bool   `yaml:"require"` // refuse unsigned announcements
+}
+
+/*
+* What a client does about a gateway that falls silent.  After timeout the
+* gateway is marked down, after a further grace period its routes and DNS
+* settings are removed, or kept with a warning.
+ */
+type Peers struct {
+	Timeout  time.Duration `yaml:"timeout"` // 0 means 3 poll intervals
+	Grace    time.Duration `yaml:"grace"`
+	OnExpiry string        `yaml:"on_expiry"` // remove or keep
+}
+
+/*
+* Choosing between gateways offering the same routes.  Clients use the live
+* gateway with the highest priority.  With preempt set a better gateway
+* takes over from the current one once it has been up for hold_down.
+ */
+type Election struct {
+	Priority int           `yaml:"priority"` // ours, as a gateway, 1-255
+	Preempt  bool          `yaml:"preempt"`
+	HoldDown time.Duration `yaml:"hold_down"`
+}
+
+/*
+* Spreading traffic over several gateways.  A client with enabled set
+* installs routes offered by more than one live gateway of the best priority
+* as multipath routes.  Gateways advertise weight, their share of it.
+ */
+type Multipath struct {
+	Enabled bool `yaml:"enabled"`
+	Weight  int  `yaml:"weight"` // ours, as a gateway, 1-256
+}
+
+/*
+* Gateways announce routes with a lifetime and announce them again every
+* third of it.  Clients drop routes whose lifetime runs out.
+ */
+type Leases struct {
+	Lifetime time.Duration `yaml:"lifetime"` // 0 means 3 poll intervals
+}
+
+/*
+* Tunnels usually have a smaller MTU than the LAN.  Gateways announce it
+* with each route and clamp the MSS of TCP connections they forward,
+* clients set it on the routes they install.
+ */
+type Mtu struct {
+	Advertise bool `yaml:"advertise"` // gateway sends its tunnel MTU
+	Apply     bool `yaml:"apply"`     // client sets MTU and advmss on routes
+	ClampMss  bool `yaml:"clamp_mss"` // gateway rewrites forwarded TCP SYNs
+}
+
+/*
+* Gateway reachability probes through the tunnel.  Once failures rounds in a
+* row get no answer from any target the gateway withdraws its routes, or
+* with on_failure: lower announces priority instead so clients prefer other
+* gateways.  It recovers after successes good rounds.  No probes, no
+* checking.
+ */
+type Health struct {
+	Probes    []Probe       `yaml:"probes"`
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Failures  int           `yaml:"failures"`
+	Successes int           `yaml:"successes"`
+	OnFailure string        `yaml:"on_failure"` // withdraw or lower
+	Priority  int           `yaml:"priority"`   // announced while failing with lower
+}
+
+type Probe struct {
+	Type   string `yaml:"type"`   // icmp or tcp
+	Target string `yaml:"target"` // address, host:port for tcp
+}
+
+/*
+* Helos go out every poll_interval, less up to jitter of it so hosts don't
+* send in step, and a peer silent for peers.timeout is down.  Clients with
+* fast enabled ask the gateways they route through for a helo every
+* interval and drop the routes of one that misses multiplier of them, as if
+* it had withdrawn them.  Gateways with fast enabled oblige, but no more
+* often than min_interval.
+ */
+type Hello struct {
+	Jitter float64   `yaml:"jitter"` // fraction of the interval, 0-0.5
+	Fast   FastHello `yaml:"fast"`
+}
+
+type FastHello struct {
+	Enabled     bool          `yaml:"enabled"`
+	Interval    time.Duration `yaml:"interval"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	Multiplier  int           `yaml:"multiplier"`
+}
+
+/*
+* Keeping a flapping tunnel from churning clients.  A gateway announces a
+* prefix that was withdrawn only once it has been back for hold_down.  With
+* dampening enabled each withdrawal also adds penalty to the prefix, halving
+* every half_life.  Past suppress the prefix isn't announced until the
+* penalty decays below reuse, at most max_suppress after the last flap.
+ */
+type Dampening struct {
+	HoldDown    time.Duration `yaml:"hold_down"`
+	Enabled     bool          `yaml:"enabled"`
+	Penalty     int           `yaml:"penalty"`
+	Suppress    int           `yaml:"suppress"`
+	Reuse       int           `yaml:"reuse"`
+	HalfLife    time.Duration `yaml:"half_life"`
+	MaxSuppress time.Duration `yaml:"max_suppress"`
+}
+
+type Psk struct {
+	Id     uint32 `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+var current *Config
+var configLock sync.Mutex
+
+/*
+* Compiled in settings.
+ */
+func Default() *Config {
+
+	c := Config{
+		PollInterval:    time.Duration(consts.POLL_INTERVAL) * time.Second,
+		GroupAddr:       consts.GroupAddr,
+		GroupAddr4:      consts.GroupAddr4,
+		Transport:       "auto",
+		NodeIDFile:      "/var/lib/link-share/node-id",
+		ListenPort:      consts.ListenPort,
+		MaxDatagramSize: consts.MaxDatagramSize,
+		Domain:          DefaultDomain,
+		Role:            "auto",
+		Interfaces: Interfaces{
+			Exclude: []string{"vmnet", "docker", "vibr"},
+		},
+		Tunnels: Tunnels{
+			Patterns: []string{"gpd", "tun"},
+		},
+		Dns: Dns{
+			Advertise: true,
+			Apply:     true,
+			Split:     true,
+			Settle:    2 * time.Second,
+		},
+		Peers: Peers{
+			OnExpiry: "remove",
+		},
+		Election: Election{
+			Priority: 100,
+			Preempt:  true,
+			HoldDown: 30 * time.Second,
+		},
+		Multipath: Multipath{
+			Weight: 1,
+		},
+		Mtu: Mtu{
+			Advertise: true,
+			Apply:     true,
+			ClampMss:  true,
+		},
+		Health: Health{
+			Interval:  10 * time.Second,
+			Timeout:   2 * time.Second,
+			Failures:  3,
+			Successes: 2,
+			OnFailure: "withdraw",
+			Priority:  1,
+		},
+		Hello: Hello{
+			Jitter: 0.1,
+			Fast: FastHello{
+				Interval:    300 * time.Millisecond,
+				MinInterval: 100 * time.Millisecond,
+				Multiplier:  3,
+			},
+		},
+		Dampening: Dampening{
+			Penalty:     1000,
+			Suppress:    2000,
+			Reuse:       750,
+			HalfLife:    2 * time.Minute,
+			MaxSuppress: 10 * time.Minute,
+		},
+		Security: Security{
+			Signing: Signing{
+				KeyFile:    "/etc/link-share/identity.key",
+				TrustStore: "/var/lib/link-share/trusted-gateways.json",
+				Tofu:       true,
+			},
+		},
+	}
+	return &c
+}
+
+/*
+* Return the active configuration.  Defaults if Load was never called.
+ */
+func Get() *Config {
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if current == nil {
+		current = Default()
+	}
+	return current
+}
+
+/*
+* Read and validate the file at path, making it the active configuration.
+* A missing file is only an error when required is set, i.e. the user named
+* the file on the command line.  Overrides, typically command line flags,
+* are applied after the file is read and before validation.
+ */
+func Load(path string, required bool, overrides ...func(*Config)) error {
+
+	c := Default()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) || required {
+			return fmt.Errorf("config %s: %w", path, err)
+		}
+		slog.Info("no config file, using defaults", "path", path)
+		b = nil
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+
+	for _, o := range overrides {
+		o(c)
+	}
+
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+
+	if b != nil {
+		slog.Info("loaded config", "path", path, "role", c.Role)
+		if len(c.Security.Keys) > 0 {
+			warnReadable(path)
+		}
+	}
+	c.activate()
+	return nil
+}
+
+func (c *Config) activate() {
+
+	configLock.Lock()
+	current = c
+	configLock.Unlock()
+}
+
+/*
+* Check every setting, reporting all problems rather than just the first.
+ */
+func (c *Config) Validate() error {
+
+	var errs []error
+
+	if c.PollInterval < time.Second {
+		errs = append(errs, fmt.Errorf("poll_interval %s must be at least 1s",
+			c.PollInterval))
+	}
+
+	group := net.ParseIP(c.GroupAddr)
+	if group == nil || group.To4() != nil || !group.IsMulticast() {
+		errs = append(errs, fmt.Errorf("group_addr %q is not an IPv6 multicast address",
+			c.GroupAddr))
+	}
+
+	// Link local groups only, they are never forwarded.
+	_, local4, _ := net.ParseCIDR(consts.MulticastPrefix4)
+	group4 := net.ParseIP(c.GroupAddr4)
+	if group4 == nil || group4.To4() == nil || !local4.Contains(group4) {
+		errs = append(errs, fmt.Errorf("group_addr4 %q is not an IPv4 multicast address in %s",
+			c.GroupAddr4, consts.MulticastPrefix4))
+	}
+
+	if c.Domain == "" || len(c.Domain) > 64 || strings.ContainsAny(c.Domain, " \t\n") {
+		errs = append(errs, fmt.Errorf("domain %q must be 1-64 characters without spaces",
+			c.Domain))
+	}
+
+	if c.NodeIDFile == "" {
+		errs = append(errs, errors.New("node_id_file must be set"))
+	}
+
+	switch c.Transport {
+	case "auto", "ipv6", "ipv4":
+	default:
+		errs = append(errs, fmt.Errorf("transport %q must be auto, ipv6 or ipv4",
+			c.Transport))
+	}
+
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port %d out of range",
+			c.ListenPort))
+	}
+
+	if c.MaxDatagramSize < 512 || c.MaxDatagramSize > 65507 {
+		errs = append(errs, fmt.Errorf("max_datagram_size %d must be between 512 and 65507",
+			c.MaxDatagramSize))
+	}
+
+	switch c.Role {
+	case "gateway", "client", "auto":
+	default:
+		errs = append(errs, fmt.Errorf("role %q must be gateway, client or auto",
+			c.Role))
+	}
+
+	for _, n := range c.Interfaces.Exclude {
+		if strings.TrimSpace(n) == "" {
+			errs = append(errs, errors.New("interfaces.exclude has an empty name"))
+		}
+	}
+
+	if len(c.Tunnels.Patterns) == 0 {
+		errs = append(errs, errors.New("tunnels.patterns must name at least one pattern"))
+	}
+	for _, n := range c.Tunnels.Patterns {
+		if strings.TrimSpace(n) == "" {
+			errs = append(errs, errors.New("tunnels.patterns has an empty pattern"))
+		}
+	}
+
+	var err error
+	c.Prefixes.include, err = parseCidrs("prefixes.include", c.Prefixes.Include)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	c.Prefixes.exclude, err = parseCidrs("prefixes.exclude", c.Prefixes.Exclude)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, c.Security.validate()...)
+	errs = append(errs, c.Health.validate()...)
+
+	if c.Hello.Jitter < 0 || c.Hello.Jitter > 0.5 {
+		errs = append(errs, fmt.Errorf("hello.jitter %g must be between 0 and 0.5",
+			c.Hello.Jitter))
+	}
+	// Fast helo settings only matter when they are used.
+	if fast := c.Hello.Fast; fast.Enabled {
+		if fast.MinInterval < 50*time.Millisecond || fast.Interval < fast.MinInterval {
+			errs = append(errs, fmt.Errorf("hello.fast.interval %s and min_interval %s must be at least 50ms, interval no shorter than min_interval",
+				fast.Interval, fast.MinInterval))
+		} else if fast.Interval >= c.PollInterval {
+			errs = append(errs, fmt.Errorf("hello.fast.interval %s must be shorter than poll_interval %s",
+				fast.Interval, c.PollInterval))
+		}
+		if fast.Multiplier < 2 || fast.Multiplier > 255 {
+			errs = append(errs, fmt.Errorf("hello.fast.multiplier %d must be between 2 and 255",
+				fast.Multiplier))
+		}
+	}
+
+	if c.Peers.Timeout < 0 || c.Peers.Grace < 0 {
+		errs = append(errs, errors.New("peers.timeout and peers.grace must not be negative"))
+	} else if c.Peers.Timeout != 0 && c.Peers.Timeout < c.PollInterval {
+		errs = append(errs, fmt.Errorf("peers.timeout %s is shorter than poll_interval %s",
+			c.Peers.Timeout, c.PollInterval))
+	}
+	if c.Election.Priority < 1 || c.Election.Priority > 255 {
+		errs = append(errs, fmt.Errorf("election.priority %d must be between 1 and 255",
+			c.Election.Priority))
+	}
+	if c.Election.HoldDown < 0 {
+		errs = append(errs, fmt.Errorf("election.hold_down %s must not be negative",
+			c.Election.HoldDown))
+	}
+	for _, d := range c.Dns.Domains {
+		if d == "" || strings.ContainsAny(d, " \t~") {
+			errs = append(errs, fmt.Errorf("dns.domains entry %q is not a domain name", d))
+		}
+	}
+	if c.Dns.Settle < 0 {
+		errs = append(errs, fmt.Errorf("dns.settle %s must not be negative",
+			c.Dns.Settle))
+	}
+	if c.Leases.Lifetime < 0 {
+		errs = append(errs, fmt.Errorf("leases.lifetime %s must not be negative",
+			c.Leases.Lifetime))
+	} else if c.Leases.Lifetime != 0 && c.Leases.Lifetime < 3*time.Second {
+		errs = append(errs, fmt.Errorf("leases.lifetime %s must be at least 3s",
+			c.Leases.Lifetime))
+	}
+	if c.Multipath.Weight < 1 || c.Multipath.Weight > 256 {
+		errs = append(errs, fmt.Errorf("multipath.weight %d must be between 1 and 256",
+			c.Multipath.Weight))
+	}
+
+	switch c.Peers.OnExpiry {
+	case "remove", "keep":
+	default:
+		errs = append(errs, fmt.Errorf("peers.on_expiry %q must be remove or keep",
+			c.Peers.OnExpiry))
+	}
+
+	errs = append(errs, c.Dampening.validate()...)
+
+	return errors.Join(errs...)
+}
+
+func (s *Security) validate() []error {
+
+	var errs []error
+	seen := map[uint32]bool{}
+
+	for _, k := range s.Keys {
+		if k.Id == 0 {
+			errs = append(errs, errors.New("security.keys: id must be 1 or more"))
+		}
+		if seen[k.Id] {
+			errs = append(errs, fmt.Errorf("security.keys: id %d used twice", k.Id))
+		}
+		seen[k.Id] = true
+		if _, err := auth.DecodeSecret(k.Secret); err != nil {
+			errs = append(errs, fmt.Errorf("security.keys: id %d: %w, create one with 'link-share key psk'",
+				k.Id, err))
+		}
+	}
+
+	if s.SendKey != 0 && !seen[s.SendKey] {
+		errs = append(errs, fmt.Errorf("security.send_key %d is not in security.keys",
+			s.SendKey))
+	}
+	if s.SendKey == 0 && len(s.Keys) > 1 {
+		errs = append(errs, errors.New("security.send_key is required with more than one key"))
+	}
+
+	if s.MaxPacketAge < 0 {
+		errs = append(errs, fmt.Errorf("security.max_packet_age %s must not be negative",
+			s.MaxPacketAge))
+	}
+
+	if !filepath.IsAbs(s.Signing.KeyFile) {
+		errs = append(errs, fmt.Errorf("security.signing.key_file %q must be an absolute path",
+			s.Signing.KeyFile))
+	}
+	if !filepath.IsAbs(s.Signing.TrustStore) {
+		errs = append(errs, fmt.Errorf("security.signing.trust_store %q must be an absolute path",
+			s.Signing.TrustStore))
+	}
+	return errs
+}
+
+func (h *Health) validate() []error {
+
+	var errs []error
+
+	for _, p := range h.Probes {
+		switch p.Type {
+		case "icmp":
+			if net.ParseIP(p.Target) == nil {
+				errs = append(errs, fmt.Errorf("health.probes: icmp target %q is not an address",
+					p.Target))
+			}
+		case "tcp":
+			if _, port, err := net.SplitHostPort(p.Target); err != nil || port == "" {
+				errs = append(errs, fmt.Errorf("health.probes: tcp target %q is not host:port",
+					p.Target))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("health.probes: type %q must be icmp or tcp",
+				p.Type))
+		}
+	}
+
+	if h.Interval < time.Second {
+		errs = append(errs, fmt.Errorf("health.interval %s must be at least 1s",
+			h.Interval))
+	}
+	if h.Timeout <= 0 || h.Timeout > h.Interval {
+		errs = append(errs, fmt.Errorf("health.timeout %s must be positive and no longer than health.interval",
+			h.Timeout))
+	}
+	if h.Failures < 1 || h.Successes < 1 {
+		errs = append(errs, errors.New("health.failures and health.successes must be at least 1"))
+	}
+
+	switch h.OnFailure {
+	case "withdraw", "lower":
+	default:
+		errs = append(errs, fmt.Errorf("health.on_failure %q must be withdraw or lower",
+			h.OnFailure))
+	}
+	if h.Priority < 1 || h.Priority > 255 {
+		errs = append(errs, fmt.Errorf("health.priority %d must be between 1 and 255",
+			h.Priority))
+	}
+	return errs
+}
+
+func (d *Dampening) validate() []error {
+
+	var errs []error
+
+	if d.HoldDown < 0 {
+		errs = append(errs, fmt.Errorf("dampening.hold_down %s must not be negative",
+			d.HoldDown))
+	}
+	if d.Penalty < 1 || d.Reuse < 1 || d.Suppress <= d.Reuse {
+		errs = append(errs, fmt.Errorf("dampening.penalty %d and reuse %d must be at least 1, suppress %d above reuse",
+			d.Penalty, d.Reuse, d.Suppress))
+	}
+	if d.HalfLife < time.Second || d.MaxSuppress < d.HalfLife {
+		errs = append(errs, fmt.Errorf("dampening.half_life %s must be at least 1s, max_suppress %s no shorter",
+			d.HalfLife, d.MaxSuppress))
+	}
+	return errs
+}
+
+/*
+* Key used to seal outgoing packets.
+ */
+func (s *Security) SendKeyID() uint32 {
+
+	if s.SendKey == 0 && len(s.Keys) == 1 {
+		return s.Keys[0].Id
+	}
+	return s.SendKey
+}
+
+func (s *Security) Secrets() map[uint32]string {
+
+	m := map[uint32]string{}
+	for _, k := range s.Keys {
+		m[k.Id] = k.Secret
+	}
+	return m
+}
+
+/*
+* Secrets belong in a file only root can read.
+ */
+func warnReadable(path string) {
+
+	st, err := os.Stat(path)
+	if err == nil && st.Mode().Perm()&0077 != 0 {
+		slog.Warn("config holds secrets but is readable by others",
+			"path", path, "mode", st.Mode().Perm())
+	}
+}
+
+func parseCidrs(key string, cidrs []string) ([]*net.IPNet, error) {
+
+	nets := []*net.IPNet{}
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a CIDR", key, s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+/*
+* Is the destination inside one of the listed networks?
+ */
+func contains(nets []*net.IPNet, dst *net.IPNet) bool {
+
+	dstBits, _ := dst.Mask.Size()
+	for _, n := range nets {
+		bits, _ := n.Mask.Size()
+		if n.Contains(dst.IP) && dstBits >= bits {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Should the destination be shared?
+ */
+func (p *Prefixes) Allowed(dst *net.IPNet) bool {
+
+	if contains(p.exclude, dst) {
+		return false
+	}
+	if len(p.include) == 0 {
+		return true
+	}
+	return contains(p.include, dst)
+}
+
+/*
+* How long a peer may stay silent before it is considered down.
+ */
+func (c *Config) PeerTimeout() time.Duration {
+
+	if c.Peers.Timeout == 0 {
+		return 3 * c.PollInterval
+	}
+	return c.Peers.Timeout
+}
+
+/*
+* Lifetime of the routes a gateway announces.
+ */
+func (c *Config) LeaseLifetime() time.Duration {
+
+	if c.Leases.Lifetime == 0 {
+		return 3 * c.PollInterval
+	}
+	return c.Leases.Lifetime
+}
+
+/*
+* Role as an enum.  Validate guarantees the string is one we know.
+ */
+func (c *Config) GetRole() consts.Role {
+
+	switch c.Role {
+	case "gateway":
+		return consts.ROLE_GATEWAY
+	case "client":
+		return consts.ROLE_CLIENT
+	}
+	return consts.ROLE_AUTO
+}
+
+/*
+* Interface name is on the exclusion list.
+ */
+func (c *Config) ExcludedInterface(name string) bool {
+
+	for _, n := range c.Interfaces.Exclude {
+		if strings.HasPrefix(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Interface name matches one of the tunnel patterns.
+ */
+func (c *Config) TunnelName(name string) bool {
+
+	for _, n := range c.Tunnels.Patterns {
+		if strings.Contains(name, n) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Wildcard address and port the protocol listens on.
+ */
+func (c *Config) ListenAddr() string {
+	return fmt.Sprintf("[::]:%d", c.ListenPort)
+}
+
+func (c *Config) ListenAddr4() string {
+	return fmt.Sprintf("0.0.0.0:%d", c.ListenPort)
+}
@@ -3,6 +3,7 @@ package consts
 const (
 	ListenAddr        string = "[::]:10210"
 	GroupAddr         string = "ff02::210"
+	GroupAddr4        string = "224.0.0.210"
 	LinkLocalPrefix6  string = "fe80"
 	MulticastPrefix6  string = "ff00"
 	LinkLocalPrexfix4 string = "169.254.0.0/16"
@@ -12,6 +13,7 @@ const (
 const (
 	MaxDatagramSize int = 9000  // Jumbo frame size.  Get from Interface maybe?
 	ListenPort      int = 10210 // Any non-priviledged port.
+	UDP6Overhead    int = 48    // IPv6 and UDP headers.
 	UP              int = 1
 	DOWN            int = 2
 )
@@ -24,6 +26,30 @@ const (
 	UNUSED
 )
 
+/*
+* Which side of the link share a host plays.
+ */
+type Role int
+
+const (
+	ROLE_AUTO Role = iota + 1
+	ROLE_GATEWAY
+	ROLE_CLIENT
+)
+
+func (r Role) String() string {
+
+	switch r {
+	case ROLE_AUTO:
+		return "auto"
+	case ROLE_GATEWAY:
+		return "gateway"
+	case ROLE_CLIENT:
+		return "client"
+	}
+	return "unknown"
+}
+
 const (
 	POLL_INTERVAL int = 60 // seconds
 )
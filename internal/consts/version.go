@@ -0,0 +1,7 @@
+package consts
+
+/*
+* Software version, set at build time with
+* -ldflags "-X github.com/code-ointment/link-share/internal/consts.Version=x.y.z"
+ */
+var Version = "dev"
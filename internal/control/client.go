@@ -0,0 +1,68 @@
+package control
+
+/*
+* Client side of the control socket.
+ */
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+type Client struct {
+	path    string
+	timeout time.Duration
+}
+
+func NewClient(path string) *Client {
+
+	c := Client{
+		path:    path,
+		timeout: 10 * time.Second,
+	}
+	return &c
+}
+
+/*
+* Send one command and decode the response data into out, which may be nil.
+ */
+func (c *Client) Call(command string, args map[string]string, out any) error {
+
+	conn, err := net.DialTimeout("unix", c.path, c.timeout)
+	if err != nil {
+		return fmt.Errorf("can't reach link-share at %s: %w", c.path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	req := Request{Version: Version, Command: command, Args: args}
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	resp := Response{}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("malformed response: %w", err)
+	}
+	if !resp.Ok {
+		return errors.New(resp.Error)
+	}
+
+	if out != nil && len(resp.Data) > 0 {
+		return json.Unmarshal(resp.Data, out)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package control
+
+/*
+* Control API spoken over the daemon's unix socket.  One JSON request per
+* connection, answered by one JSON response.  Version is bumped whenever a
+* field changes meaning or is removed, new fields may be added freely.
+ */
+import (
+	"encoding/json"
+)
+
+const (
+	Version       int    = 1
+	DefaultSocket string = "/run/link-share/control.sock"
+)
+
+// Commands understood by the server.
+const (
+	CmdStatus   string = "status"
+	CmdPeers    string = "peers"
+	CmdRoutes   string = "routes"
+	CmdDns      string = "dns"
+	CmdResync   string = "resync"
+	CmdWithdraw string = "withdraw"
+	CmdLogLevel string = "log-level"
+	CmdStop     string = "stop"
+)
+
+type Request struct {
+	Version int               `json:"version"`
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args,omitempty"`
+}
+
+type Response struct {
+	Version int             `json:"version"`
+	Ok      bool            `json:"ok"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+/*
+* Everything the daemon knows.
+ */
+type Status struct {
+	NodeID     string    `json:"node_id"`
+	Hostname   string    `json:"hostname"`
+	Version    string    `json:"version"`
+	Started    int64     `json:"started"` // unix seconds
+	Domain     string    `json:"domain"`  // sharing domain
+	Foreign    uint64    `json:"foreign"` // packets from other domains ignored
+	Role       string    `json:"role"`
+	ActiveRole string    `json:"active_role"`
+	Configured bool      `json:"configured"`
+	Withdrawn  bool      `json:"withdrawn"` // operator withdrew, until a resync
+	DryRun     bool      `json:"dry_run"`
+	Generation uint64    `json:"generation"`             // of the state we announce
+	Priority   uint32    `json:"priority"`               // ours as a gateway
+	FastHelo   int64     `json:"fast_helo_ms,omitempty"` // interval clients asked of us
+	Links      []Link    `json:"links"`                  // interfaces the protocol runs on
+	Health     *Health   `json:"health,omitempty"`       // tunnel probes, gateways only
+	Peers      []Peer    `json:"peers"`
+	Routes     RouteInfo `json:"routes"`
+	Dns        DnsState  `json:"dns"`
+	Nft        NftState  `json:"nftables"`
+	Security   Security  `json:"security"`
+}
+
+type Link struct {
+	Name      string `json:"name"`
+	Transport string `json:"transport"` // ipv6 or ipv4
+	Group     string `json:"group"`
+}
+
+type Health struct {
+	State     string        `json:"state"`      // ok or failing
+	OnFailure string        `json:"on_failure"` // withdraw or lower
+	Probes    []ProbeResult `json:"probes"`
+}
+
+type ProbeResult struct {
+	Type     string  `json:"type"`
+	Target   string  `json:"target"`
+	Ok       bool    `json:"ok"`
+	Rtt      float64 `json:"rtt_ms,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Checked  int64   `json:"checked,omitempty"` // unix seconds
+	Failures int     `json:"failures"`          // in a row
+}
+
+type Peer struct {
+	ID       string `json:"id"` // node id
+	Hostname string `json:"hostname,omitempty"`
+	Address  string `json:"address"`
+	State    string `json:"state"`
+	LastSeen int64  `json:"last_seen"` // unix seconds
+
+	Addresses    []string `json:"addresses,omitempty"` // every address heard from
+	Version      string   `json:"version,omitempty"`
+	Role         string   `json:"role,omitempty"`
+	Started      int64    `json:"started,omitempty"` // unix seconds, from its uptime
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	Generation uint64 `json:"generation,omitempty"` // last applied from this gateway
+	Priority   uint32 `json:"priority,omitempty"`   // gateway priority
+	Health     string `json:"health,omitempty"`     // ok or failing, from its probes
+
+	FastInterval int64 `json:"fast_interval_ms,omitempty"` // its fast helos, when we asked
+	DeadAfter    int64 `json:"dead_after_ms"`              // silence before it is down
+}
+
+type RouteInfo struct {
+	Learned   []Route `json:"learned"`   // tunnel routes a gateway shares
+	Installed []Route `json:"installed"` // routes a client added
+
+	Dampened []Dampened `json:"dampened,omitempty"` // learned routes that flapped
+}
+
+type Dampened struct {
+	Dest    string `json:"dest"`
+	State   string `json:"state"` // announced, held, suppressed or withdrawn
+	Flaps   int    `json:"flaps"`
+	Penalty int    `json:"penalty"`
+}
+
+type Route struct {
+	Op      string   `json:"op,omitempty"`
+	Dest    string   `json:"dest"`
+	Gateway string   `json:"gateway,omitempty"`
+	Ifname  string   `json:"ifname,omitempty"`
+	Owner   string   `json:"owner,omitempty"`   // name of the gateway host that announced it
+	Standby []string `json:"standby,omitempty"` // others offering it
+	Hops    []Hop    `json:"hops,omitempty"`    // next hops of a multipath route
+	Expires int64    `json:"expires,omitempty"` // unix seconds the owner's lease ends
+}
+
+type Hop struct {
+	Gateway string `json:"gateway"`
+	Owner   string `json:"owner"`
+	Weight  int    `json:"weight"`
+}
+
+type DnsState struct {
+	Backend       string `json:"backend"`
+	Link          string `json:"link"`
+	Nameservers   string `json:"nameservers"`
+	Searchdomains string `json:"searchdomains"`
+	BackedUp      bool   `json:"backed_up"`          // original config saved, ours applied
+	Owner         string `json:"owner,omitempty"`    // gateway whose settings are applied
+	Settling      bool   `json:"settling,omitempty"` // a change waits for dns.settle
+
+	Routes []DnsRoute `json:"routes,omitempty"` // split DNS routing domains applied
+}
+
+type DnsRoute struct {
+	Domains     []string `json:"domains"`
+	Nameservers []string `json:"nameservers"`
+}
+
+type NftState struct {
+	RoutingEnabled bool     `json:"routing_enabled"`
+	Link           string   `json:"link"`
+	Tables         []string `json:"tables"`
+}
+
+type Security struct {
+	PskEnabled      bool     `json:"psk_enabled"`
+	SendKey         uint32   `json:"send_key,omitempty"`
+	Keys            []uint32 `json:"keys,omitempty"`
+	AuthFailures    uint64   `json:"auth_failures"`   // sealed but wouldn't open
+	Unauthenticated uint64   `json:"unauthenticated"` // refused, not sealed
+
+	Identity         string      `json:"identity,omitempty"` // our signing key fingerprint
+	RequireSigned    bool        `json:"require_signed"`
+	Tofu             bool        `json:"tofu"`
+	Pinned           []PinnedKey `json:"pinned"`
+	SignatureRejects uint64      `json:"signature_rejects"`
+	ReplayRejects    uint64      `json:"replay_rejects"`
+}
+
+type PinnedKey struct {
+	Gateway     string `json:"gateway"`
+	Fingerprint string `json:"fingerprint"`
+	Source      string `json:"source"`
+}
+
+/*
+* Implemented by the daemon.
+ */
+type Backend interface {
+	Status() *Status
+	Resync() error
+	Withdraw() error
+	SetLogLevel(level string) error
+	Stop() error
+}
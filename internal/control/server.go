@@ -0,0 +1,202 @@
+package control
+
+/*
+* Unix socket server.  The socket lives in a root only directory and peers
+* are additionally checked for uid 0 with SO_PEERCRED.
+ */
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type Server struct {
+	path     string
+	backend  Backend
+	listener *net.UnixListener
+}
+
+func NewServer(path string, backend Backend) *Server {
+
+	s := Server{
+		path:    path,
+		backend: backend,
+	}
+	return &s
+}
+
+/*
+* Create the socket and launch the accept thread.
+ */
+func (s *Server) Start() error {
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("control dir %s: %w", dir, err)
+	}
+	os.Chmod(dir, 0700)
+
+	// Left over from a previous run.
+	os.Remove(s.path)
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: s.path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("control socket %s: %w", s.path, err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("control socket %s: %w", s.path, err)
+	}
+
+	s.listener = l
+	slog.Info("control socket listening", "path", s.path)
+	go s.acceptLoop()
+	return nil
+}
+
+func (s *Server) Stop() {
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	os.Remove(s.path)
+}
+
+func (s *Server) acceptLoop() {
+
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("control accept failed", "error", err)
+			continue
+		}
+		go s.serve(conn)
+	}
+}
+
+/*
+* Only root may talk to us.
+ */
+func (s *Server) peerIsRoot(conn *net.UnixConn) bool {
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd),
+			unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if credErr != nil {
+		slog.Warn("control peer credentials", "error", credErr)
+		return false
+	}
+	return cred.Uid == 0
+}
+
+func (s *Server) serve(conn *net.UnixConn) {
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if !s.peerIsRoot(conn) {
+		slog.Warn("control request from non root peer refused")
+		s.reply(conn, nil, errors.New("permission denied"))
+		return
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		slog.Debug("control read failed", "error", err)
+		return
+	}
+
+	req := Request{}
+	if err := json.Unmarshal(line, &req); err != nil {
+		s.reply(conn, nil, fmt.Errorf("malformed request: %w", err))
+		return
+	}
+
+	if req.Version > Version {
+		s.reply(conn, nil, fmt.Errorf("unsupported version %d, server speaks %d",
+			req.Version, Version))
+		return
+	}
+
+	slog.Debug("control request", "command", req.Command)
+	data, err := s.dispatch(&req)
+	s.reply(conn, data, err)
+}
+
+func (s *Server) dispatch(req *Request) (any, error) {
+
+	switch req.Command {
+
+	case CmdStatus:
+		return s.backend.Status(), nil
+
+	case CmdPeers:
+		return s.backend.Status().Peers, nil
+
+	case CmdRoutes:
+		return s.backend.Status().Routes, nil
+
+	case CmdDns:
+		return s.backend.Status().Dns, nil
+
+	case CmdResync:
+		return nil, s.backend.Resync()
+
+	case CmdWithdraw:
+		return nil, s.backend.Withdraw()
+
+	case CmdLogLevel:
+		level, ok := req.Args["level"]
+		if !ok {
+			return nil, errors.New("log-level requires a level argument")
+		}
+		return nil, s.backend.SetLogLevel(level)
+
+	case CmdStop:
+		return nil, s.backend.Stop()
+	}
+	return nil, fmt.Errorf("unknown command %q", req.Command)
+}
+
+func (s *Server) reply(conn *net.UnixConn, data any, err error) {
+
+	resp := Response{Version: Version, Ok: err == nil}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	if data != nil {
+		b, merr := json.Marshal(data)
+		if merr != nil {
+			resp.Ok = false
+			resp.Error = merr.Error()
+		} else {
+			resp.Data = b
+		}
+	}
+
+	b, _ := json.Marshal(&resp)
+	b = append(b, '\n')
+	if _, err := conn.Write(b); err != nil {
+		slog.Debug("control write failed", "error", err)
+	}
+}
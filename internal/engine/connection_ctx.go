@@ -4,26 +4,31 @@ import (
 	"net"
 
 	"github.com/code-ointment/link-share/internal/inet"
-	"golang.org/x/net/ipv6"
 )
 
 /*
-* Assocaite IP Addresses, Interface, and IPv6 packet connection.
+* Assocaite IP Addresses, Interface, and the packet connections of its
+* transports.
  */
 
 type ConnectionCtx struct {
-	Addrs   []net.IP
-	Intf    *net.Interface
-	PktConn *ipv6.PacketConn
+	Addrs      []net.IP
+	Intf       *net.Interface
+	Transports []TransportConn
 }
 
-func NewConnectionCtx(
-	eth *net.Interface,
-	addrList []net.Addr,
-	pc *ipv6.PacketConn) ConnectionCtx {
+/*
+* A transport in use on an interface.
+ */
+type TransportConn struct {
+	PktConn   packetConn
+	Transport string       // ipv6 or ipv4
+	Group     *net.UDPAddr // where packets are sent
+}
+
+func NewConnectionCtx(eth *net.Interface, addrList []net.Addr) ConnectionCtx {
 
-	ctx := ConnectionCtx{Intf: eth,
-		PktConn: pc}
+	ctx := ConnectionCtx{Intf: eth}
 	for _, ipa := range addrList {
 		ip := inet.AddrToIP(ipa)
 		ctx.Addrs = append(ctx.Addrs, ip)
@@ -31,6 +36,15 @@ func NewConnectionCtx(
 	return ctx
 }
 
+func (ce *ConnectionCtx) AddTransport(pc packetConn, transport string) {
+
+	ce.Transports = append(ce.Transports, TransportConn{
+		PktConn:   pc,
+		Transport: transport,
+		Group:     groupAddr(transport),
+	})
+}
+
 /*
 * Return the first IPv4 addr in the list.
 * TODO: upgrade to use something like the netip library.  ip.To4 can give
@@ -0,0 +1,251 @@
+package engine
+
+/*
+* Control socket support.  Snapshot the engine state and carry out operator
+* commands.
+ */
+import (
+	"log/slog"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/control"
+	"github.com/code-ointment/link-share/internal/inet"
+	"github.com/code-ointment/link-share/link_proto"
+	"golang.org/x/sys/unix"
+)
+
+func (pe *ProtocolEngine) Status() *control.Status {
+
+	st := control.Status{
+		Role:       pe.role.String(),
+		ActiveRole: "undecided",
+		DryRun:     config.Get().DryRun,
+		Peers:      []control.Peer{},
+		Generation: pe.generation.Load(),
+		Priority:   pe.priority(),
+		NodeID:     pe.sender,
+		Hostname:   pe.hostname,
+		Version:    consts.Version,
+		Started:    pe.started.Unix(),
+		Domain:     pe.domain,
+		Foreign:    pe.otherDomain.Load(),
+	}
+	if pe.activeRole != 0 {
+		st.ActiveRole = pe.activeRole.String()
+	}
+
+	if pe.prober != nil {
+		st.Health = pe.healthStatus()
+	}
+
+	pe.mutex.Lock()
+	st.Configured = pe.configured
+	st.Withdrawn = pe.withdrawn
+	st.FastHelo = pe.fastIntervalLocked().Milliseconds()
+	for _, c := range pe.connections {
+		for _, t := range c.Transports {
+			st.Links = append(st.Links, control.Link{
+				Name:      c.Intf.Name,
+				Transport: t.Transport,
+				Group:     t.Group.IP.String(),
+			})
+		}
+	}
+	names := map[string]string{}
+	for _, h := range pe.hosts {
+		state := "down"
+		if h.State == consts.UP {
+			state = "up"
+		}
+		addr := ""
+		if h.IP != nil {
+			addr = h.IP.String()
+		}
+		p := control.Peer{
+			ID:           h.ID,
+			Hostname:     h.Hostname,
+			Address:      addr,
+			State:        state,
+			LastSeen:     h.UpdateTime,
+			Generation:   h.Generation,
+			Priority:     h.Priority,
+			Version:      h.Version,
+			Role:         h.Role,
+			Capabilities: capabilityNames(h.Capabilities),
+			Health:       healthName(h.Health),
+			FastInterval: h.FastInterval.Milliseconds(),
+		}
+		dead, _ := deadInterval(h)
+		p.DeadAfter = dead.Milliseconds()
+		if !h.Started.IsZero() {
+			p.Started = h.Started.Unix()
+		}
+		for _, a := range h.Addrs {
+			p.Addresses = append(p.Addresses, a.IP.String())
+		}
+		st.Peers = append(st.Peers, p)
+		names[h.ID] = h.Name()
+	}
+	pe.mutex.Unlock()
+
+	// Gateways are shown by name.
+	name := func(id string) string {
+		if n, ok := names[id]; ok {
+			return n
+		}
+		return id
+	}
+
+	st.Routes.Learned = []control.Route{}
+	for _, u := range pe.rm.GetRouteUpdates() {
+		st.Routes.Learned = append(st.Routes.Learned, control.Route{
+			Op:     opName(u.Op),
+			Dest:   inet.IPNetToCidr(&u.Dst),
+			Ifname: u.Ifname,
+		})
+	}
+
+	st.Routes.Dampened = pe.damper.status()
+
+	st.Routes.Installed = []control.Route{}
+	for _, rt := range pe.rm.GetSelfRoutes() {
+		r := control.Route{
+			Dest:  inet.IPNetToCidr(rt.Dst),
+			Owner: name(rt.Owner),
+		}
+		for _, o := range pe.rm.Standby(r.Dest, rt.Hops) {
+			r.Standby = append(r.Standby, name(o))
+		}
+		if rt.Gw != nil {
+			r.Gateway = rt.Gw.String()
+		}
+		if exp := pe.rm.LeaseExpiry(r.Dest, rt.Owner); !exp.IsZero() {
+			r.Expires = exp.Unix()
+		}
+		link := rt.LinkIndex
+		if len(rt.MultiPath) > 0 {
+			link = rt.MultiPath[0].LinkIndex
+			for _, h := range rt.Hops {
+				r.Hops = append(r.Hops, control.Hop{
+					Gateway: h.Gateway,
+					Owner:   name(h.Owner),
+					Weight:  h.Weight,
+				})
+			}
+		}
+		if l := pe.ifm.GetLinkByIndex(link); l != nil {
+			r.Ifname = l.Attrs().Name
+		}
+		st.Routes.Installed = append(st.Routes.Installed, r)
+	}
+
+	st.Dns.Backend = pe.dnsConfig.Backend()
+	st.Dns.BackedUp = pe.dnsConfig.IsBackedUp()
+	pe.mutex.Lock()
+	if pe.dnsOwner != "" {
+		st.Dns.Owner = name(pe.dnsOwner)
+	}
+	st.Dns.Settling = pe.dnsPending != ""
+	pe.mutex.Unlock()
+	if l := pe.ifm.GetDefaultLink(); l != nil {
+		st.Dns.Link = l.Attrs().Name
+		st.Dns.Nameservers = pe.dnsConfig.GetNameServers(st.Dns.Link)
+		st.Dns.Searchdomains = pe.dnsConfig.GetDomains(st.Dns.Link)
+		for _, r := range pe.dnsConfig.GetDnsRoutes(st.Dns.Link) {
+			st.Dns.Routes = append(st.Dns.Routes, control.DnsRoute{
+				Domains:     r.Domains,
+				Nameservers: r.Nameservers,
+			})
+		}
+	}
+
+	nfu := pe.rm.GetNftUtil()
+	st.Nft.RoutingEnabled = pe.rm.RoutingEnabled()
+	st.Nft.Link = nfu.LinkName()
+	st.Nft.Tables = nfu.Tables()
+
+	st.Security.AuthFailures = pe.authFailures.Load()
+	st.Security.Unauthenticated = pe.unauthenticated.Load()
+	if pe.keyring != nil {
+		st.Security.PskEnabled = true
+		st.Security.SendKey = pe.keyring.SendKeyID()
+		st.Security.Keys = pe.keyring.KeyIDs()
+	}
+
+	signing := config.Get().Security.Signing
+	st.Security.RequireSigned = signing.Require
+	st.Security.Tofu = signing.Tofu
+	st.Security.SignatureRejects = pe.signatureRejects.Load()
+	st.Security.ReplayRejects = pe.replayRejects.Load()
+	st.Security.Pinned = []control.PinnedKey{}
+	if pe.identity != nil {
+		st.Security.Identity = pe.identity.Fingerprint()
+	}
+	if pe.trust != nil {
+		for _, e := range pe.trust.List() {
+			st.Security.Pinned = append(st.Security.Pinned, control.PinnedKey{
+				Gateway:     e.Gateway,
+				Fingerprint: e.Fingerprint,
+				Source:      e.Source,
+			})
+		}
+	}
+
+	return &st
+}
+
+func opName(op uint16) string {
+
+	switch op {
+	case unix.RTM_NEWROUTE:
+		return "add"
+	case unix.RTM_DELROUTE:
+		return "delete"
+	}
+	return "unknown"
+}
+
+/*
+* Gateways re-advertise everything, clients ask the gateways to do so.
+ */
+func (pe *ProtocolEngine) Resync() error {
+
+	slog.Info("resync requested")
+	pe.mutex.Lock()
+	pe.withdrawn = false
+	pe.mutex.Unlock()
+
+	if pe.role != consts.ROLE_CLIENT && pe.rm.LearnedCount() > 0 {
+		pe.AdvertiseRoutes()
+	}
+	if pe.role != consts.ROLE_GATEWAY {
+		pe.sendHelo(link_proto.HeloRequest_INIT)
+	}
+	return nil
+}
+
+/*
+* Gateways announce an empty state, so clients drop our routes, and stop
+* advertising until a resync.  Clients drop the routes and DNS settings they
+* installed and ignore announcements until a resync.
+ */
+func (pe *ProtocolEngine) Withdraw() error {
+
+	slog.Info("withdraw requested")
+
+	pe.mutex.Lock()
+	if pe.role != consts.ROLE_CLIENT && !pe.withdrawn &&
+		pe.rm.LearnedCount() > 0 {
+		pe.SendAdvertisement(nil)
+	}
+	pe.withdrawn = true
+	pe.mutex.Unlock()
+
+	pe.Shutdown()
+
+	pe.mutex.Lock()
+	pe.configured = false
+	pe.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,275 @@
+package engine
+
+/*
+* Route flap dampening on gateways, after BGP's (RFC 2439).  A flaky VPN
+* deletes and re-adds its routes, and each change would go out to every
+* client.  Prefixes that were withdrawn are held down, only announced again
+* once back for the hold down time.  With dampening enabled every
+* withdrawal also adds a penalty that decays exponentially, a prefix whose
+* penalty passes the suppress threshold isn't announced until it decays
+* below reuse.  Prefixes that never flapped go out as before.
+ */
+import (
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/control"
+	"github.com/code-ointment/link-share/internal/events"
+	"github.com/code-ointment/link-share/internal/inet"
+	"golang.org/x/sys/unix"
+)
+
+const dampeningTick = time.Second
+
+/*
+* History of a prefix that flapped.
+ */
+type flapState struct {
+	penalty    float64
+	decayed    time.Time // penalty is as of then
+	flaps      int
+	suppressed bool
+	present    bool      // learned route exists
+	since      time.Time // present since
+	announced  bool      // in the last set published
+}
+
+type damper struct {
+	mutex  sync.Mutex
+	states map[string]*flapState // by destination
+	now    func() time.Time
+}
+
+func newDamper() *damper {
+	return &damper{states: map[string]*flapState{}, now: time.Now}
+}
+
+/*
+* Record learned route changes.
+ */
+func (d *damper) note(evs []events.Event) {
+
+	cfg := config.Get().Dampening
+	if cfg.HoldDown == 0 && !cfg.Enabled {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, ev := range evs {
+
+		st, ok := d.states[ev.Name]
+		switch ev.Kind {
+
+		case events.RouteWithdrawn:
+			// Learned routes are announced, unless this had a history.
+			if !ok {
+				st = &flapState{decayed: ev.Time, announced: true}
+				d.states[ev.Name] = st
+			}
+			st.present = false
+			st.flaps++
+			if !cfg.Enabled {
+				continue
+			}
+			st.decay(ev.Time)
+			st.penalty = math.Min(st.penalty+float64(cfg.Penalty), ceiling())
+			if !st.suppressed && st.penalty >= float64(cfg.Suppress) {
+				st.suppressed = true
+				slog.Warn("route flapping, suppressing", "dst", ev.Name,
+					"penalty", int(st.penalty), "flaps", st.flaps)
+			}
+
+		case events.RouteLearned:
+			if ok {
+				st.present = true
+				st.since = ev.Time
+			}
+		}
+	}
+}
+
+/*
+* Highest penalty, one that takes max_suppress to decay to reuse.
+ */
+func ceiling() float64 {
+
+	cfg := config.Get().Dampening
+	return float64(cfg.Reuse) * math.Exp2(cfg.MaxSuppress.Seconds()/
+		cfg.HalfLife.Seconds())
+}
+
+func (st *flapState) decay(now time.Time) {
+
+	dt := now.Sub(st.decayed)
+	if dt <= 0 {
+		return
+	}
+	st.penalty *= math.Exp2(-dt.Seconds() / config.Get().Dampening.HalfLife.Seconds())
+	st.decayed = now
+}
+
+/*
+* May the prefix be announced now?  Hold down only keeps back a prefix whose
+* withdrawal went out, a delete and add within one set never reached
+* clients.  Called with the object lock held.
+ */
+func (st *flapState) allowed(dst string, now time.Time, announced bool) bool {
+
+	cfg := config.Get().Dampening
+	st.decay(now)
+
+	if st.suppressed {
+		if st.penalty >= float64(cfg.Reuse) {
+			return false
+		}
+		st.suppressed = false
+		slog.Info("route stable again, reusing", "dst", dst,
+			"penalty", int(st.penalty))
+	}
+	return announced || now.Sub(st.since) >= cfg.HoldDown
+}
+
+/*
+* Learned routes that may be announced, given the route manager's current
+* ones.
+ */
+func (d *damper) filter(rts []inet.RouteUpdate) []inet.RouteUpdate {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.states) == 0 {
+		return rts
+	}
+
+	now := d.now()
+	seen := map[string]bool{}
+	out := []inet.RouteUpdate{}
+	for _, rt := range rts {
+
+		if rt.Op != unix.RTM_NEWROUTE {
+			out = append(out, rt)
+			continue
+		}
+		dst := inet.IPNetToCidr(&rt.Dst)
+		seen[dst] = true
+		st, ok := d.states[dst]
+		if !ok {
+			out = append(out, rt)
+			continue
+		}
+
+		if !st.present {
+			st.present = true
+			st.since = now
+		}
+		st.announced = st.allowed(dst, now, st.announced)
+		if st.announced {
+			out = append(out, rt)
+		} else {
+			slog.Debug("flapping route held back", "dst", dst,
+				"penalty", int(st.penalty), "suppressed", st.suppressed)
+		}
+	}
+
+	for dst, st := range d.states {
+		if !seen[dst] {
+			st.present = false
+			st.announced = false
+		}
+	}
+	d.forget(now)
+	return out
+}
+
+/*
+* Drop prefixes that have been stable long enough to have no history left.
+* Called with the object lock held.
+ */
+func (d *damper) forget(now time.Time) {
+
+	hold := config.Get().Dampening.HoldDown
+	for dst, st := range d.states {
+		st.decay(now)
+		if st.present && st.announced && !st.suppressed && st.penalty < 1 &&
+			now.Sub(st.since) >= hold {
+			delete(d.states, dst)
+		}
+	}
+}
+
+/*
+* Would publishing now change what we announce?
+ */
+func (d *damper) due() bool {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	for dst, st := range d.states {
+		if st.present && !st.announced && st.allowed(dst, now, false) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Go routine announcing prefixes whose hold down or suppression ends.
+ */
+func (pe *ProtocolEngine) dampeningThread() {
+
+	if pe.role == consts.ROLE_CLIENT {
+		return
+	}
+
+	for {
+		time.Sleep(dampeningTick)
+		if pe.damper.due() {
+			slog.Info("held back routes may be announced again")
+			pe.AdvertiseRoutes()
+		}
+	}
+}
+
+/*
+* Flap history for status.
+ */
+func (d *damper) status() []control.Dampened {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	list := []control.Dampened{}
+	for dst, st := range d.states {
+		st.decay(now)
+		state := "announced"
+		switch {
+		case !st.present:
+			state = "withdrawn"
+		case st.suppressed:
+			state = "suppressed"
+		case !st.announced:
+			state = "held"
+		}
+		list = append(list, control.Dampened{
+			Dest:    dst,
+			State:   state,
+			Flaps:   st.flaps,
+			Penalty: int(st.penalty),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Dest < list[j].Dest
+	})
+	return list
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/events"
+	"github.com/code-ointment/link-share/internal/inet"
+	"golang.org/x/sys/unix"
+)
+
+const flapDst = "10.99.0.0/16"
+
+var flapStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+/*
+* One step of a flap history, at offset from flapStart.  Events go to note,
+* then filter runs with the route present or not and must announce it or
+* hold it back.  With due set the step checks due instead of filtering.
+ */
+type flapStep struct {
+	at       time.Duration
+	events   []events.Kind
+	present  bool
+	announce bool
+	due      bool
+}
+
+func useDampening(t *testing.T, d config.Dampening) {
+
+	t.Helper()
+	err := config.Load(filepath.Join(t.TempDir(), "none.yaml"), false,
+		func(c *config.Config) { c.Dampening = d })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flapRoutes(present bool) []inet.RouteUpdate {
+
+	rts := []inet.RouteUpdate{}
+	if present {
+		_, dst, _ := net.ParseCIDR(flapDst)
+		rts = append(rts, inet.RouteUpdate{Op: unix.RTM_NEWROUTE, Dst: *dst,
+			Ifname: "tun0"})
+	}
+	return rts
+}
+
+func TestDamper(t *testing.T) {
+
+	holdDown := config.Dampening{
+		HoldDown:    5 * time.Second,
+		Penalty:     1000,
+		Suppress:    2000,
+		Reuse:       750,
+		HalfLife:    time.Minute,
+		MaxSuppress: 10 * time.Minute,
+	}
+	off := holdDown
+	off.HoldDown = 0
+	dampening := off
+	dampening.Enabled = true
+	// Penalties decay between flaps, two in quick succession fall short
+	// of 2000.
+	dampening.Suppress = 1900
+
+	withdrawn := []events.Kind{events.RouteWithdrawn}
+	learned := []events.Kind{events.RouteLearned}
+	flap := []events.Kind{events.RouteWithdrawn, events.RouteLearned}
+
+	tests := []struct {
+		name   string
+		config config.Dampening
+		steps  []flapStep
+		states int // left once done
+	}{
+		{
+			name:   "delete and add in one batch isn't held",
+			config: holdDown,
+			steps: []flapStep{
+				{at: 0, present: true, announce: true},
+				{at: time.Second, events: flap, present: true, announce: true},
+			},
+			states: 1,
+		},
+		{
+			name:   "hold down releases after hold_down",
+			config: holdDown,
+			steps: []flapStep{
+				{at: 0, present: true, announce: true},
+				{at: time.Second, events: withdrawn},
+				{at: 2 * time.Second, events: learned, present: true},
+				{at: 6 * time.Second, due: true},
+				{at: 6 * time.Second, present: true},
+				{at: 7 * time.Second, due: true, announce: true},
+				{at: 7 * time.Second, present: true, announce: true},
+			},
+			states: 0,
+		},
+		{
+			name:   "suppression lifts below reuse",
+			config: dampening,
+			steps: []flapStep{
+				{at: 0, present: true, announce: true},
+				{at: time.Second, events: flap, present: true, announce: true},
+				{at: 2 * time.Second, events: withdrawn},
+				{at: 3 * time.Second, events: learned, present: true},
+				{at: 4 * time.Second, events: flap, present: true},
+				// About 2940 at 4s, below 750 after another 118s.
+				{at: 120 * time.Second, due: true},
+				{at: 120 * time.Second, present: true},
+				{at: 125 * time.Second, due: true, announce: true},
+				{at: 125 * time.Second, present: true, announce: true},
+			},
+			states: 1,
+		},
+		{
+			name:   "forget drops stable prefixes",
+			config: holdDown,
+			steps: []flapStep{
+				{at: 0, present: true, announce: true},
+				{at: time.Second, events: withdrawn},
+				{at: 2 * time.Second, events: learned, present: true},
+				{at: 8 * time.Second, present: true, announce: true},
+			},
+			states: 0,
+		},
+		{
+			name:   "forget waits for the penalty to decay",
+			config: dampening,
+			steps: []flapStep{
+				{at: 0, present: true, announce: true},
+				{at: time.Second, events: flap, present: true, announce: true},
+				{at: time.Minute, present: true, announce: true},
+				// 1000 takes ten half lives to fall below 1.
+				{at: 11 * time.Minute, present: true, announce: true},
+			},
+			states: 0,
+		},
+		{
+			name:   "nothing configured",
+			config: off,
+			steps: []flapStep{
+				{at: 0, present: true, announce: true},
+				{at: time.Second, events: withdrawn},
+				{at: 2 * time.Second, events: learned, present: true,
+					announce: true},
+			},
+			states: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			useDampening(t, tt.config)
+			d := newDamper()
+
+			for i, s := range tt.steps {
+
+				now := flapStart.Add(s.at)
+				d.now = func() time.Time { return now }
+
+				evs := []events.Event{}
+				for _, k := range s.events {
+					evs = append(evs, events.Event{Kind: k, Name: flapDst,
+						Link: "tun0", Time: now})
+				}
+				d.note(evs)
+
+				if s.due {
+					if got := d.due(); got != s.announce {
+						t.Fatalf("step %d at %s: due %t, want %t", i, s.at,
+							got, s.announce)
+					}
+					continue
+				}
+				if len(s.events) > 0 && !s.present {
+					d.filter(flapRoutes(false))
+					continue
+				}
+				got := len(d.filter(flapRoutes(s.present))) == 1
+				if got != s.announce {
+					t.Fatalf("step %d at %s: announced %t, want %t", i, s.at,
+						got, s.announce)
+				}
+			}
+
+			if len(d.states) != tt.states {
+				t.Fatalf("%d prefixes with history, want %d", len(d.states),
+					tt.states)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package engine
+
+/*
+* Gateway election.  Gateways announce a priority and clients install each
+* route through the live gateway with the highest priority, ties going to
+* the lowest node id.  As with VRRP preemption a better gateway only takes
+* over once it has been up for the hold down time, so a rebooting gateway
+* doesn't pull routes back and forth.  A gateway whose helos stop is marked down by
+* HostAccounting and loses its routes to the next best one at once.
+ */
+import (
+	"slices"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+)
+
+const electionTick = time.Second
+
+/*
+* Record that we heard from the host.  Called with the object lock held.
+ */
+func (h *Host) markAlive(priority uint32) {
+
+	now := time.Now()
+	if h.State != consts.UP {
+		h.UpSince = now
+	}
+	h.State = consts.UP
+	h.UpdateTime = now.Unix()
+	h.heard = now
+	h.Priority = priority
+}
+
+/*
+* Our priority as a gateway, announced in helos and announcements.
+ */
+func (pe *ProtocolEngine) priority() uint32 {
+
+	if pe.role == consts.ROLE_CLIENT {
+		return 0
+	}
+	cfg := config.Get()
+	if pe.unhealthy.Load() && cfg.Health.OnFailure == "lower" {
+		return uint32(cfg.Health.Priority)
+	}
+	return uint32(cfg.Election.Priority)
+}
+
+/*
+* Is a preferred over b?
+ */
+func preferred(a *Host, b *Host) bool {
+
+	if b == nil {
+		return true
+	}
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.ID < b.ID
+}
+
+/*
+* Chooser handed to the route manager.
+ */
+func (pe *ProtocolEngine) choose(dest string, owners []string, current string) string {
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	return pe.chooseLocked(owners, current)
+}
+
+/*
+* Pick among the gateways in owners.  Called with the object lock held.
+ */
+func (pe *ProtocolEngine) chooseLocked(owners []string, current string) string {
+
+	cfg := config.Get().Election
+
+	var best *Host
+	var cur *Host
+	var bestAny *Host
+	for _, o := range owners {
+		h := pe.findHost(o)
+		if h == nil {
+			continue
+		}
+		if o == current {
+			cur = h
+		}
+		if preferred(h, bestAny) {
+			bestAny = h
+		}
+		if h.State == consts.UP && preferred(h, best) {
+			best = h
+		}
+	}
+
+	// Nobody live, leave things be until the expiry policy steps in.
+	if best == nil {
+		if cur != nil || current != "" && slices.Contains(owners, current) {
+			return current
+		}
+		if bestAny != nil {
+			return bestAny.ID
+		}
+		return owners[0]
+	}
+
+	if cur == nil || cur.State != consts.UP || cur == best {
+		return best.ID
+	}
+
+	// The current gateway is alive, only a better one preempts it, and
+	// only after the hold down.
+	if !cfg.Preempt || best.Priority <= cur.Priority ||
+		time.Since(best.UpSince) < cfg.HoldDown {
+		return current
+	}
+	return best.ID
+}
+
+/*
+* Go routine re-running the election, so hold downs that expire take
+* effect.
+ */
+func (pe *ProtocolEngine) electionThread() {
+
+	if pe.role == consts.ROLE_GATEWAY {
+		return
+	}
+
+	for {
+		time.Sleep(electionTick)
+		pe.reelect()
+	}
+}
+
+func (pe *ProtocolEngine) reelect() {
+
+	pe.rm.Resettle()
+
+	pe.mutex.Lock()
+	pe.applyDns()
+	pe.mutex.Unlock()
+}
@@ -1,43 +1,133 @@
 package engine
 
 import (
+	"errors"
 	"log/slog"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/code-ointment/link-share/internal/auth"
+	"github.com/code-ointment/link-share/internal/config"
 	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/events"
 	"github.com/code-ointment/link-share/internal/inet"
+	"github.com/code-ointment/link-share/internal/probe"
 	"github.com/code-ointment/link-share/link_proto"
-	"golang.org/x/net/ipv6"
-	"google.golang.org/protobuf/proto"
 )
 
 type ProtocolEngine struct {
 	ifm         *inet.InterfaceManager
 	rm          *inet.RouteManager
+	bus         *events.Bus
+	routeEvents *events.Subscription // learned routes, for advertising
+	linkEvents  *events.Subscription // tunnels coming and going
+	damper      *damper              // flapping learned routes
 	dnsConfig   inet.DnsConfig
 	connections []ConnectionCtx
 	mutex       sync.Mutex
 	localAddrs  []net.Addr
-	domain      string
+	domain      string  // sharing domain, packets for others are ignored
 	hosts       []*Host // Not sure I need this...
 	configured  bool    // received one announcement.
+	role        consts.Role
+	activeRole  consts.Role // what auto mode is currently doing
+	withdrawn   bool        // operator withdrew our routes, stay quiet
+	tunnelDown  bool        // no tunnel up, announce our link DOWN
+
+	prober    *probe.Prober // tunnel health probes, nil when none
+	unhealthy atomic.Bool   // probes failing
+
+	keyring          *auth.Keyring    // nil when packets travel in the clear
+	identity         *auth.Identity   // gateway signing key, may be nil
+	trust            *auth.TrustStore // pinned gateway keys, clients only
+	authFailures     atomic.Uint64
+	unauthenticated  atomic.Uint64
+	signatureRejects atomic.Uint64
+
+	sender        string // our node id, the name in packet headers
+	hostname      string
+	started       time.Time
+	epoch         uint64 // start time, orders our restarts
+	sequence      atomic.Uint64
+	replayRejects atomic.Uint64
+	otherDomain   atomic.Uint64 // packets from other sharing domains
+	setID         atomic.Uint32 // numbers announcement sets
+
+	generation atomic.Uint64          // of the state we last announced
+	published  string                 // that state, routes and DNS settings
+	appliedDns string                 // announced DNS settings we applied
+	dnsOwner   string                 // host whose DNS settings those are
+	dnsByOwner map[string]dnsSettings // what each gateway announced
+	fastAsked  []string               // gateways asked for fast helos
+
+	dnsPending      string    // DNS change waiting to settle
+	dnsPendingSince time.Time // when it was first wanted
 }
 
 func NewProtocolEngine() *ProtocolEngine {
 
 	pe := ProtocolEngine{}
-	pe.ifm = inet.NewInterfaceManager()
+	cfg := config.Get()
+	pe.role = cfg.GetRole()
+	pe.epoch = uint64(time.Now().UnixNano())
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Error("can't get hostname", "error", err)
+		os.Exit(1)
+	}
+	pe.hostname = hostname
+	pe.started = time.Now()
+
+	pe.sender, err = loadNodeID(cfg.NodeIDFile)
+	if err != nil {
+		slog.Error("can't load node id", "path", cfg.NodeIDFile, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("node identity", "id", pe.sender, "hostname", hostname,
+		"version", consts.Version)
+
+	if len(cfg.Security.Keys) > 0 {
+		kr, err := auth.NewKeyring(cfg.Security.Secrets(),
+			cfg.Security.SendKeyID())
+		if err != nil {
+			slog.Error("failed loading keys", "error", err)
+			os.Exit(1)
+		}
+		pe.keyring = kr
+		slog.Info("packet authentication enabled",
+			"send key", kr.SendKeyID(), "keys", kr.KeyIDs())
+	}
+	pe.initSigning()
+
+	// Subscribe before anything publishes.
+	pe.bus = events.NewBus()
+	pe.routeEvents = pe.bus.Subscribe(events.RouteLearned, events.RouteWithdrawn)
+	pe.linkEvents = pe.bus.Subscribe(events.LinkUp, events.LinkDown)
+	pe.logEvents()
+
+	pe.ifm = inet.NewInterfaceManager(pe.bus)
 	pe.ifm.Start()
+	pe.tunnelDown = pe.ifm.HasTunnels() && !pe.ifm.TunnelsUp()
 
 	dnsFactory := inet.NewResolverConfigFactory()
 	pe.dnsConfig = dnsFactory.GetDNSConfig()
 
-	pe.rm = inet.NewRouteManager(pe.ifm)
+	pe.rm = inet.NewRouteManager(pe.ifm, pe.role, pe.bus)
+	pe.rm.SetChooser(pe.choose)
+	pe.rm.SetSpreader(pe.spread)
 	pe.rm.Start()
 
-	pe.domain = "placeholder"
+	if pe.role != consts.ROLE_CLIENT && len(cfg.Health.Probes) > 0 {
+		pe.prober = probe.NewProber(pe.ifm)
+	}
+
+	pe.damper = newDamper()
+	pe.dnsByOwner = map[string]dnsSettings{}
+	pe.domain = cfg.Domain
 	pe.configured = false
 
 	return &pe
@@ -48,27 +138,34 @@ func NewProtocolEngine() *ProtocolEngine {
  */
 func (pe *ProtocolEngine) Start() {
 
+	pe.logRole()
 	pe.setupMulticast()
 	pe.listen()
 
 	go pe.AdvertiseUpdates()
+	go pe.watchLinks()
+	go pe.electionThread()
+	go pe.leaseRefreshThread()
+	go pe.leaseExpiryThread()
+	go pe.livenessThread()
+	go pe.fastHeloThread()
+	go pe.dampeningThread()
+
+	if pe.prober != nil {
+		pe.prober.Start()
+		go pe.watchHealth()
+	}
 }
 
 /*
-* Allocating socket which is used to set up packet connections on a per
-* interface basis.
+* Allocating sockets which are used to set up packet connections on a per
+* interface basis.  Each transport's socket is opened once and shared.
  */
 func (pe *ProtocolEngine) setupMulticast() {
 
-	var err error
 	// Get Netlinks idea of an interface
 	interfaces := pe.ifm.GetInterfaces()
-
-	listener, err := net.ListenPacket("udp6", consts.ListenAddr)
-	if err != nil {
-		slog.Error("listen packet failed", "addr", consts.ListenAddr, "error", err)
-		os.Exit(0)
-	}
+	listeners := map[string]packetConn{}
 
 	for _, intf := range interfaces {
 
@@ -80,22 +177,37 @@ func (pe *ProtocolEngine) setupMulticast() {
 			os.Exit(0)
 		}
 
-		slog.Debug("setup multicast", "interface", eth.Name)
-		group := net.ParseIP(consts.GroupAddr)
-		packetConnection := ipv6.NewPacketConn(listener)
-		if err := packetConnection.JoinGroup(eth, &net.UDPAddr{IP: group}); err != nil {
-			slog.Error("Failed joining group", "addr", consts.GroupAddr, "error", err)
-			os.Exit(1)
-		}
-
 		alist, err := eth.Addrs()
 		if err != nil {
 			slog.Error("error getting int addresses", "error", err)
 			continue
 		}
 
+		entry := NewConnectionCtx(eth, alist)
+		for _, transport := range pickTransports(alist) {
+
+			listener, ok := listeners[transport]
+			if !ok {
+				listener, err = openTransport(transport)
+				if err != nil {
+					slog.Error("listen packet failed", "transport", transport,
+						"error", err)
+					os.Exit(0)
+				}
+				listeners[transport] = listener
+			}
+
+			group := groupAddr(transport)
+			slog.Debug("setup multicast", "interface", eth.Name,
+				"transport", transport, "group", group.IP)
+			if err := listener.JoinGroup(eth, group.IP); err != nil {
+				slog.Error("Failed joining group", "addr", group.IP, "error", err)
+				os.Exit(1)
+			}
+			entry.AddTransport(listener, transport)
+		}
+
 		pe.mutex.Lock()
-		entry := NewConnectionCtx(eth, alist, packetConnection)
 		pe.connections = append(pe.connections, entry)
 		pe.localAddrs = append(pe.localAddrs, alist...)
 		pe.mutex.Unlock()
@@ -103,32 +215,34 @@ func (pe *ProtocolEngine) setupMulticast() {
 }
 
 /*
-* Launch service threads.  1 thread per interface for now.
+* Launch service threads.  1 thread per interface and transport for now.
  */
 func (pe *ProtocolEngine) listen() {
 
 	for _, c := range pe.connections {
-		go pe.listenOnConnection(c)
+		for _, t := range c.Transports {
+			go pe.listenOnConnection(t)
+		}
 	}
 }
 
 /*
 * Read from the interface and dispatch request.
  */
-func (pe *ProtocolEngine) listenOnConnection(entry ConnectionCtx) {
+func (pe *ProtocolEngine) listenOnConnection(entry TransportConn) {
 
-	mgroup := net.ParseIP(consts.GroupAddr)
-	buffer := make([]byte, consts.MaxDatagramSize)
+	cfg := config.Get()
+	buffer := make([]byte, cfg.MaxDatagramSize)
 
 	for {
 
-		n, cm, addr, err := entry.PktConn.ReadFrom(buffer)
+		n, dst, addr, err := entry.PktConn.ReadFrom(buffer)
 		if err != nil {
 			slog.Error("readfrom failed", "error", err)
 			continue
 		}
 
-		if cm != nil && cm.Dst != nil && !cm.Dst.Equal(mgroup) {
+		if dst != nil && !dst.Equal(entry.Group.IP) {
 			slog.Warn("errant packet")
 			continue
 		}
@@ -139,22 +253,83 @@ func (pe *ProtocolEngine) listenOnConnection(entry ConnectionCtx) {
 		}
 
 		slog.Debug("recv", "addr", addr.String(), "bytes", n)
-		packet := link_proto.Packet{}
-		if err = proto.Unmarshal(buffer[:n], &packet); err != nil {
-			slog.Error("Failed unmarshalling", "error", err)
+		packet, signer, err := pe.decode(buffer[:n])
+		if err != nil {
+			slog.Warn("dropping packet", "addr", addr.String(), "error", err)
+			continue
+		}
+
+		// Another link-share group sharing the LAN.
+		if d := packetDomain(packet); d != pe.domain {
+			pe.otherDomain.Add(1)
+			slog.Debug("other sharing domain, ignoring", "addr", addr.String(),
+				"domain", d)
+			continue
+		}
+
+		// Trust is settled before the packet may move the sender's window.
+		announce := packet.GetAnnounce()
+		if announce != nil && !pe.trustAnnounce(announce, signer) {
+			continue
+		}
+
+		host, isNew, err := pe.checkReplay(packet.GetHeader(), signer,
+			announce != nil)
+		if errors.Is(err, errDuplicate) {
+			// Dual stack peers send each packet over both transports.
+			slog.Debug("duplicate packet", "addr", addr.String(),
+				"transport", entry.Transport)
+			continue
+		}
+		if errors.Is(err, errWrongSigner) {
+			slog.Warn("dropping packet not signed by the sender's key",
+				"addr", addr.String(), "sender", packet.GetHeader().GetSender())
+			continue
+		}
+		if errors.Is(err, errPacketAge) {
+			slog.Warn("dropping packet, check the host clocks are in sync",
+				"addr", addr.String(), "error", err)
+			continue
+		}
+		if err != nil {
+			slog.Warn("dropping replayed packet", "addr", addr.String(),
+				"error", err)
+			continue
 		}
 
 		switch pp := packet.Pkttype.(type) {
 
 		case *link_proto.Packet_Helo:
-			pe.HeloHandler(pp.Helo)
+			pe.HeloHandler(host, isNew, pp.Helo)
 
 		case *link_proto.Packet_Announce:
-			pe.AnnounceHandler(pp.Announce)
+			pe.notePeerAddr(host, pp.Announce.GetGateway())
+			if an := pe.reassemble(host, pp.Announce); an != nil {
+				pe.AnnounceHandler(host, an)
+			}
 		}
 	}
 }
 
+/*
+* Sharing domain a packet belongs to, the default one when none is set.
+ */
+func packetDomain(pkt *link_proto.Packet) string {
+
+	d := ""
+	switch pp := pkt.Pkttype.(type) {
+	case *link_proto.Packet_Helo:
+		d = pp.Helo.GetDomain()
+	case *link_proto.Packet_Announce:
+		d = pp.Announce.GetDomain()
+	}
+
+	if d == "" {
+		return config.DefaultDomain
+	}
+	return d
+}
+
 /*
 * Is this address assigned to one of my interfaces?
  */
@@ -175,22 +350,61 @@ func (pe *ProtocolEngine) IsLocalAddr(addr net.Addr) bool {
 	return false
 }
 
+/*
+* Report the configured role, or for auto what the host looks like at start.
+ */
+func (pe *ProtocolEngine) logRole() {
+
+	if pe.role != consts.ROLE_AUTO {
+		slog.Info("role set by configuration", "role", pe.role)
+		pe.activeRole = pe.role
+		return
+	}
+
+	if pe.rm.LearnedCount() > 0 {
+		pe.pickRole(consts.ROLE_GATEWAY, "tunnel routes present at start up")
+		return
+	}
+	slog.Info("auto role, no tunnel routes yet, waiting to act as client or gateway")
+}
+
+/*
+* Auto mode acts as both gateway and client.  Note when the host starts
+* acting as one or the other and why.
+ */
+func (pe *ProtocolEngine) pickRole(role consts.Role, reason string) {
+
+	if pe.role != consts.ROLE_AUTO || pe.activeRole == role {
+		return
+	}
+	slog.Info("auto role picked", "role", role, "reason", reason)
+	pe.activeRole = role
+}
+
 func (pe *ProtocolEngine) getHeloRequest() link_proto.HeloRequest {
 
-	// Host is configured, say hello
-	if pe.configured {
+	// Host is configured, or withdrawn and not asking for state, say hello
+	pe.mutex.Lock()
+	quiet := pe.configured || pe.withdrawn
+	pe.mutex.Unlock()
+	if quiet {
 		return link_proto.HeloRequest_HELO
 	}
+
+	// Gateways have nothing to ask for.
+	if pe.role == consts.ROLE_GATEWAY {
+		return link_proto.HeloRequest_HELO
+	}
+	if pe.role == consts.ROLE_CLIENT {
+		return link_proto.HeloRequest_INIT
+	}
+
 	//
 	// Host has a tunnel that is up.
 	// TODO: revisit tunnel condition, what if there are other tunnels?
 	//
-	if pe.ifm.HasTunnels() {
-		for _, tun := range pe.ifm.GetTunnels() {
-			if pe.ifm.IsUp(tun) {
-				return link_proto.HeloRequest_HELO
-			}
-		}
+	if pe.ifm.TunnelsUp() {
+		return link_proto.HeloRequest_HELO
 	}
 
 	return link_proto.HeloRequest_INIT
@@ -200,13 +414,15 @@ func (pe *ProtocolEngine) getHeloRequest() link_proto.HeloRequest {
 * Send a helo on all interfaces.
  */
 func (pe *ProtocolEngine) SendHelo() {
+	pe.sendHelo(pe.getHeloRequest())
+}
 
-	mgroup := net.ParseIP(consts.GroupAddr)
-	dst := &net.UDPAddr{IP: mgroup, Port: consts.ListenPort}
+func (pe *ProtocolEngine) sendHelo(request link_proto.HeloRequest) {
 
 	pe.mutex.Lock()
-	for _, c := range pe.connections {
+	for i := range pe.connections {
 
+		c := &pe.connections[i]
 		myAddr := c.GetIPv6Addr()
 		if myAddr == nil {
 			slog.Debug("no IPv6 Address available, trying IPv4")
@@ -214,25 +430,19 @@ func (pe *ProtocolEngine) SendHelo() {
 		}
 
 		helo := link_proto.Helo{
-			Ipaddr:  myAddr.String(),
-			Domain:  pe.domain,
-			Request: pe.getHeloRequest(),
+			Ipaddr:     myAddr.String(),
+			Domain:     pe.domain,
+			Request:    request,
+			Generation: pe.generation.Load(),
+			Priority:   pe.priority(),
 		}
+		pe.describe(&helo)
+		pe.describeFast(&helo)
 		pph := link_proto.Packet_Helo{Helo: &helo}
 		pkt := link_proto.Packet{
 			Pkttype: &pph,
 		}
-
-		out, err := proto.Marshal(&pkt)
-		if err != nil {
-			slog.Error("Failed marshaling", "error", err)
-			os.Exit(1)
-		}
-
-		_, err = c.PktConn.WriteTo(out, nil, dst)
-		if err != nil {
-			slog.Error("failed writing", "error", err)
-		}
+		pe.sendPacket(c, &pkt)
 	}
 	pe.mutex.Unlock()
 }
@@ -242,11 +452,36 @@ func (pe *ProtocolEngine) SendHelo() {
  */
 func (pe *ProtocolEngine) Shutdown() {
 
-	if !pe.configured {
+	pe.announceDown()
+
+	pe.mutex.Lock()
+	configured := pe.configured
+	pe.mutex.Unlock()
+	if !configured {
 		slog.Debug("shutdown - no configuration to withdraw")
 		return
 	}
 
 	pe.dnsConfig.RestoreConfig()
 	pe.rm.DropSelfRoutes()
+	pe.appliedDns = ""
+	pe.dnsOwner = ""
+	pe.dnsPending = ""
+	pe.dnsByOwner = map[string]dnsSettings{}
+}
+
+/*
+* Go routine logging every event at debug level.
+ */
+func (pe *ProtocolEngine) logEvents() {
+
+	sub := pe.bus.Subscribe()
+	go func() {
+		for {
+			for _, ev := range sub.Wait() {
+				slog.Debug("event", "kind", ev.Kind, "name", ev.Name,
+					"link", ev.Link)
+			}
+		}
+	}()
 }
@@ -0,0 +1,286 @@
+package engine
+
+/*
+* Desired state sync.  A gateway numbers each distinct state of its routes
+* and DNS settings with a generation and always announces the whole state.
+* Clients make their routes through that gateway match the latest
+* generation.  Helos carry the gateway's generation too, so a client that
+* missed an announcement notices the gap and asks for a resync.
+*
+* Generations count from 1 within a gateway's epoch, a restarted gateway
+* starts over.
+ */
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/events"
+	"github.com/code-ointment/link-share/internal/inet"
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+/*
+* Generation for the state about to be announced, bumped when it differs
+* from the last one.  Called with the object lock held.
+ */
+func (pe *ProtocolEngine) publish(lstate link_proto.LinkState,
+	routes []*link_proto.Route, nameservers string, searchdomains string,
+	dnsRoutes []*link_proto.DnsRoute) uint64 {
+
+	dests := []string{}
+	for _, r := range routes {
+		dests = append(dests, fmt.Sprintf("%s@%d", r.GetDest(), r.GetMtu()))
+	}
+	sort.Strings(dests)
+	state := lstate.String() + "|" + strings.Join(dests, ",") + "|" +
+		nameservers + "|" + searchdomains + "|" +
+		dnsRoutesString(toDnsRoutes(dnsRoutes))
+
+	if state != pe.published || pe.generation.Load() == 0 {
+		pe.published = state
+		gen := pe.generation.Add(1)
+		slog.Info("new generation", "generation", gen, "routes", len(dests))
+	}
+	return pe.generation.Load()
+}
+
+/*
+* Record a generation announced by the host.  Older generations from the
+* same epoch are out of date and refused.  Called with the object lock held.
+ */
+func (h *Host) acceptGeneration(gen uint64) bool {
+
+	if h.genEpoch != h.Replay.epoch {
+		h.genEpoch = h.Replay.epoch
+		h.Generation = gen
+		return true
+	}
+
+	if gen < h.Generation {
+		return false
+	}
+	if h.Generation != 0 && gen > h.Generation+1 {
+		slog.Info("generation gap, applying full state", "host", h.ID,
+			"had", h.Generation, "got", gen)
+	}
+	h.Generation = gen
+	return true
+}
+
+/*
+* Does the host's helo show a generation we haven't applied?  Called with
+* the object lock held.
+ */
+func (h *Host) missedGeneration(gen uint64) bool {
+
+	if gen == 0 {
+		return false
+	}
+	return h.genEpoch != h.Replay.epoch || h.Generation < gen
+}
+
+/*
+* Make the routes the announcing gateway owns, and the DNS settings, match
+* the announced state.  A gateway whose link is down wants none.
+ */
+func (pe *ProtocolEngine) reconcile(h *Host, an *link_proto.Announce) {
+
+	cfg := config.Get()
+	gw := an.GetGateway()
+	gw6 := an.GetGateway6()
+
+	routes := an.GetRoutes()
+	if an.GetLstate() == link_proto.LinkState_DOWN {
+		routes = nil
+	}
+
+	now := time.Now()
+	want := map[string]inet.Claim{}
+	for _, rt := range routes {
+
+		_, dst, err := net.ParseCIDR(rt.GetDest())
+		if err != nil {
+			slog.Warn("bad route in announcement", "dst", rt.GetDest())
+			continue
+		}
+		if !cfg.Prefixes.Allowed(dst) {
+			slog.Debug("prefix filtered, ignoring", "dst", rt.GetDest())
+			continue
+		}
+
+		via := gw
+		if dst.IP.To4() == nil && gw6 != "" {
+			via = gw6
+		}
+		claim := inet.Claim{Gateway: via}
+		if cfg.Mtu.Apply {
+			claim.MTU = int(rt.GetMtu())
+		}
+		if rt.GetLifetime() > 0 {
+			claim.Expires = now.Add(time.Duration(rt.GetLifetime()) * time.Second)
+		}
+		want[inet.IPNetToCidr(dst)] = claim
+	}
+
+	added, deleted := pe.rm.SyncRoutes(h.ID, want)
+	slog.Info("announcement applied", "host", h.ID, "gw", gw,
+		"generation", an.GetGeneration(), "routes", len(want),
+		"added", added, "deleted", deleted)
+
+	pe.syncDns(h.ID, dnsSettings{
+		nameservers:   an.GetNameservers(),
+		searchdomains: an.GetSearchdomains(),
+		routes:        toDnsRoutes(an.GetDnsRoutes()),
+	})
+}
+
+func toDnsRoutes(routes []*link_proto.DnsRoute) []inet.DnsRoute {
+
+	r := []inet.DnsRoute{}
+	for _, dr := range routes {
+		if len(dr.GetDomains()) == 0 || len(dr.GetNameservers()) == 0 {
+			continue
+		}
+		r = append(r, inet.DnsRoute{
+			Domains:     dr.GetDomains(),
+			Nameservers: dr.GetNameservers(),
+		})
+	}
+	return r
+}
+
+/*
+* "domain,domain>server,server;..." for comparing and logging.
+ */
+func dnsRoutesString(routes []inet.DnsRoute) string {
+
+	s := []string{}
+	for _, r := range routes {
+		s = append(s, strings.Join(r.Domains, ",")+">"+
+			strings.Join(r.Nameservers, ","))
+	}
+	return strings.Join(s, ";")
+}
+
+/*
+* Record the DNS settings a gateway announced, forgetting them once it
+* offers no routes, and apply whichever gateway's settings should be in use.
+ */
+func (pe *ProtocolEngine) syncDns(owner string, ds dnsSettings) {
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	if ds.nameservers == "" && len(ds.routes) == 0 ||
+		pe.rm.ClaimCount(owner) == 0 {
+		delete(pe.dnsByOwner, owner)
+	} else {
+		pe.dnsByOwner[owner] = ds
+	}
+	pe.applyDns()
+}
+
+/*
+* DNS follows the gateway election, with the original settings going back
+* once no gateway has any left.  Changes wait for dns.settle, so flapping
+* gateways don't have the resolver rewritten over and over; the election
+* thread calls again once that has passed.  Called with the object lock
+* held.
+ */
+func (pe *ProtocolEngine) applyDns() {
+
+	// Withdrawn by the operator, the original settings stay until a resync.
+	if pe.withdrawn {
+		return
+	}
+
+	owner := ""
+	if config.Get().Dns.Apply && len(pe.dnsByOwner) > 0 {
+		names := []string{}
+		for o := range pe.dnsByOwner {
+			names = append(names, o)
+		}
+		sort.Strings(names)
+		owner = pe.chooseLocked(names, pe.dnsOwner)
+	}
+
+	if owner == "" {
+		if pe.dnsOwner != "" && pe.dnsConfig.IsBackedUp() {
+			if !pe.dnsSettled("restore") {
+				return
+			}
+			slog.Info("no gateway dns left, restoring", "was", pe.dnsOwner)
+			pe.dnsConfig.RestoreConfig()
+			pe.bus.Publish(events.Event{Kind: events.DnsChanged})
+		}
+		pe.dnsOwner = ""
+		pe.appliedDns = ""
+		pe.dnsPending = ""
+		return
+	}
+
+	// Split DNS when the gateway sent routing domains, all of it otherwise.
+	ds := pe.dnsByOwner[owner]
+	routes := []inet.DnsRoute{}
+	if config.Get().Dns.Split {
+		routes = ds.routes
+	}
+	state := ds.nameservers + "|" + ds.searchdomains + "|" +
+		dnsRoutesString(routes)
+	if owner == pe.dnsOwner && state == pe.appliedDns &&
+		pe.dnsConfig.IsBackedUp() {
+		pe.dnsPending = ""
+		return
+	}
+	if !pe.dnsSettled(owner + "|" + state) {
+		return
+	}
+	if pe.dnsOwner != "" && owner != pe.dnsOwner {
+		slog.Info("dns failover", "from", pe.dnsOwner, "to", owner)
+	}
+
+	// Back up the original settings once, before the first change.
+	if !pe.dnsConfig.IsBackedUp() && !pe.dnsConfig.BackupConfig() {
+		return
+	}
+
+	intf := pe.ifm.GetDefaultLink()
+	pe.dnsConfig.SetNameServers(intf.Attrs().Name, ds.nameservers)
+	pe.dnsConfig.SetDomains(intf.Attrs().Name, ds.searchdomains)
+	pe.dnsConfig.SetDnsRoutes(intf.Attrs().Name, routes)
+	if pe.dnsConfig.Commit() {
+		if len(routes) > 0 {
+			slog.Info("split dns applied", "owner", owner,
+				"routes", dnsRoutesString(routes))
+		}
+		pe.appliedDns = state
+		pe.dnsOwner = owner
+		pe.bus.Publish(events.Event{Kind: events.DnsChanged,
+			Name: intf.Attrs().Name})
+	}
+}
+
+/*
+* Has the wanted DNS change stayed the same for dns.settle?  Called with the
+* object lock held.
+ */
+func (pe *ProtocolEngine) dnsSettled(want string) bool {
+
+	settle := config.Get().Dns.Settle
+	if settle == 0 {
+		return true
+	}
+
+	if want != pe.dnsPending {
+		pe.dnsPending = want
+		pe.dnsPendingSince = time.Now()
+		slog.Debug("dns change settling", "settle", settle)
+		return false
+	}
+	return time.Since(pe.dnsPendingSince) >= settle
+}
@@ -0,0 +1,97 @@
+package engine
+
+/*
+* Tunnel health.  A gateway with health probes configured stops offering
+* its routes while the probes fail, announcing its link DOWN like a gateway
+* whose tunnel went away, or with on_failure: lower keeps them and announces
+* the lower health priority so clients move to other gateways.  Clients
+* learn the probe outcome from the announcements.
+ */
+import (
+	"log/slog"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/control"
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+/*
+* Go routine following the probe results.
+ */
+func (pe *ProtocolEngine) watchHealth() {
+
+	for range pe.prober.Changes() {
+
+		healthy := pe.prober.Healthy()
+		if pe.unhealthy.Swap(!healthy) == !healthy {
+			continue
+		}
+
+		action := config.Get().Health.OnFailure
+		if healthy {
+			slog.Info("tunnel reachable again", "action", action)
+		} else {
+			slog.Warn("tunnel unreachable", "action", action,
+				"priority", pe.priority())
+		}
+		pe.AdvertiseRoutes()
+	}
+}
+
+/*
+* Should we keep our routes to ourselves?
+ */
+func (pe *ProtocolEngine) healthWithdrawn() bool {
+	return pe.unhealthy.Load() && config.Get().Health.OnFailure == "withdraw"
+}
+
+/*
+* Probe outcome for announcements.
+ */
+func (pe *ProtocolEngine) health() link_proto.Health {
+
+	if pe.prober == nil {
+		return link_proto.Health_HEALTH_UNKNOWN
+	}
+	if pe.unhealthy.Load() {
+		return link_proto.Health_HEALTH_FAILING
+	}
+	return link_proto.Health_HEALTH_OK
+}
+
+func (pe *ProtocolEngine) healthStatus() *control.Health {
+
+	hs := control.Health{
+		State:     healthName(pe.health()),
+		OnFailure: config.Get().Health.OnFailure,
+		Probes:    []control.ProbeResult{},
+	}
+	for _, r := range pe.prober.Results() {
+		pr := control.ProbeResult{
+			Type:     r.Type,
+			Target:   r.Target,
+			Ok:       r.Ok,
+			Error:    r.Error,
+			Failures: r.Failures,
+		}
+		if r.Ok {
+			pr.Rtt = float64(r.Rtt.Microseconds()) / 1000
+		}
+		if !r.Checked.IsZero() {
+			pr.Checked = r.Checked.Unix()
+		}
+		hs.Probes = append(hs.Probes, pr)
+	}
+	return &hs
+}
+
+func healthName(h link_proto.Health) string {
+
+	switch h {
+	case link_proto.Health_HEALTH_OK:
+		return "ok"
+	case link_proto.Health_HEALTH_FAILING:
+		return "failing"
+	}
+	return ""
+}
@@ -8,46 +8,66 @@ import (
 	"net"
 	"time"
 
+	"github.com/code-ointment/link-share/internal/config"
 	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/events"
 	"github.com/code-ointment/link-share/link_proto"
 )
 
-func (pe *ProtocolEngine) HeloHandler(hi *link_proto.Helo) {
+func (pe *ProtocolEngine) HeloHandler(h *Host, isNew bool, hi *link_proto.Helo) {
 
 	pe.mutex.Lock()
 	defer pe.mutex.Unlock()
 
-	ip := net.ParseIP(hi.Ipaddr)
-	h := pe.findHost(ip)
+	h.learn(hi)
+	h.markAlive(hi.Priority)
+	pe.noteFast(h, hi)
 
-	if h == nil {
-		h = NewHost(ip)
-		pe.hosts = append(pe.hosts, h)
-		slog.Debug("new host", "host", h.IP.String())
+	// We missed an announcement, ask for the gateway's current state.
+	if pe.role != consts.ROLE_GATEWAY && h.missedGeneration(hi.Generation) {
+		slog.Info("behind gateway generation, requesting resync",
+			"host", h.ID, "have", h.Generation, "gateway", hi.Generation)
+		go pe.sendHelo(link_proto.HeloRequest_INIT)
+	}
 
-		// New guy on the block.  Send routes we have learned.
+	if isNew {
+		// New guy on the block.  Send routes we have learned and tell it
+		// who we are rather than have it wait for our next helo.
 		pe.AdvertiseRoutesUL()
+		go pe.sendHelo(link_proto.HeloRequest_HELO)
 		return
 	}
 
 	// Remote host is requesting an update.
 	if hi.Request == link_proto.HeloRequest_INIT {
-		slog.Debug("init request", "host", h.IP.String())
+		slog.Debug("init request", "host", h.ID)
 		pe.AdvertiseRoutesUL()
+		go pe.sendHelo(link_proto.HeloRequest_HELO)
 	}
 
-	slog.Debug("update host", "host", h.IP.String())
-	h.State = consts.UP
-	h.UpdateTime = time.Now().Unix()
+	slog.Debug("update host", "host", h.ID, "hostname", h.Hostname,
+		"addr", h.IP.String())
+}
+
+/*
+* Hosts first heard through an announcement take the gateway address until
+* a helo says otherwise.
+ */
+func (pe *ProtocolEngine) notePeerAddr(h *Host, addr string) {
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	h.noteAddr(net.ParseIP(addr))
 }
 
 /*
 * Probably not a lot of hosts on the net.  Linear search for now.
  */
-func (pe *ProtocolEngine) findHost(ipaddr net.IP) *Host {
+func (pe *ProtocolEngine) findHost(id string) *Host {
 
 	for _, h := range pe.hosts {
-		if h.IP.Equal(ipaddr) {
+		if h.ID == id {
 			return h
 		}
 	}
@@ -55,24 +75,85 @@ func (pe *ProtocolEngine) findHost(ipaddr net.IP) *Host {
 }
 
 /*
-* Eject hosts that we haven't heard from in 3 polling periods
+* Mark hosts we haven't heard from within the peer timeout, or their fast
+* helo dead interval, down, and eject them once the grace period passes as
+* well.
  */
 func (pe *ProtocolEngine) HostAccounting() {
 
+	cfg := config.Get()
+	timeout := cfg.PeerTimeout()
+	grace := cfg.Peers.Grace
+
 	pe.mutex.Lock()
-	defer pe.mutex.Unlock()
 
-	now := time.Now().Unix()
+	now := time.Now()
 	hosts := []*Host{}
+	expired := []*Host{}
+	failed := []*Host{}
+	wentDown := false
 
 	for _, h := range pe.hosts {
 
-		delta := now - h.UpdateTime
-		if delta > int64(3*consts.POLL_INTERVAL) {
-			slog.Info("host timed out,removing", "host", h.IP.String())
-		} else {
+		silent := now.Sub(h.heard)
+		dead, fast := deadInterval(h)
+		switch {
+		case silent > timeout+grace:
+			expired = append(expired, h)
+		case silent > dead:
+			if h.State == consts.UP {
+				slog.Warn("host silent, marking down", "host", h.ID,
+					"silent", silent.Round(time.Millisecond), "grace", grace)
+				h.State = consts.DOWN
+				wentDown = true
+				if fast {
+					failed = append(failed, h)
+				}
+			}
+			hosts = append(hosts, h)
+		default:
 			hosts = append(hosts, h)
 		}
 	}
 	pe.hosts = hosts
+	pe.mutex.Unlock()
+
+	// Let a live gateway take over from the silent one.
+	if wentDown {
+		pe.reelect()
+	}
+
+	for _, h := range failed {
+		pe.gatewayFailed(h)
+	}
+	for _, h := range expired {
+		pe.bus.Publish(events.Event{Kind: events.PeerExpired, Name: h.ID})
+		pe.expireHost(h)
+	}
+}
+
+/*
+* Deal with whatever an expired host left installed.
+ */
+func (pe *ProtocolEngine) expireHost(h *Host) {
+
+	owned := pe.rm.ClaimCount(h.ID)
+	pe.mutex.Lock()
+	_, ownsDns := pe.dnsByOwner[h.ID]
+	pe.mutex.Unlock()
+
+	if owned == 0 && !ownsDns {
+		slog.Info("host timed out,removing", "host", h.ID)
+		return
+	}
+
+	if config.Get().Peers.OnExpiry == "keep" {
+		slog.Warn("gateway timed out, keeping its routes", "host", h.ID,
+			"routes", owned, "dns", ownsDns)
+		return
+	}
+
+	slog.Warn("gateway timed out, removing its routes", "host", h.ID,
+		"routes", owned, "dns", ownsDns)
+	pe.dropGateway(h.ID)
 }
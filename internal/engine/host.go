@@ -8,19 +8,59 @@ import (
 	"time"
 
 	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/inet"
+	"github.com/code-ointment/link-share/link_proto"
 )
 
 type Host struct {
+	ID         string // node id, the sender in packet headers
 	State      int
-	IP         net.IP
+	IP         net.IP     // address it advertises
+	Addrs      []PeerAddr // addresses it was heard from, latest first
 	UpdateTime int64
+	heard      time.Time // last helo or announcement, finer than UpdateTime
+	Replay     ReplayWindow
+	Signer     []byte                 // key its trusted announcements are signed with
+	Pending    map[uint32]*pendingSet // partial announcement sets by set id
+	Generation uint64                 // last generation applied
+	genEpoch   uint64                 // epoch Generation belongs to
+	Priority   uint32                 // gateway priority it announced
+	UpSince    time.Time              // when it last came up
+	Weight     uint32                 // multipath weight it announced
+	Health     link_proto.Health      // its tunnel probes, from announcements
+
+	FastWanted   time.Duration // helo interval it asks of us
+	FastInterval time.Duration // interval it sends fast helos at, if we asked
+
+	// From its helos.
+	Hostname     string
+	Version      string
+	Role         string
+	Started      time.Time
+	Capabilities uint32
+}
+
+type PeerAddr struct {
+	IP   net.IP
+	Seen time.Time
+}
+
+/*
+* DNS settings a gateway announced.
+ */
+type dnsSettings struct {
+	nameservers   string
+	searchdomains string
+	routes        []inet.DnsRoute // routing domains, when the gateway sent any
 }
 
-func NewHost(ip net.IP) *Host {
+func NewHost(id string) *Host {
 	h := Host{
+		ID:         id,
 		State:      consts.DOWN,
-		IP:         ip,
 		UpdateTime: time.Now().Unix(),
+		heard:      time.Now(),
+		Pending:    map[uint32]*pendingSet{},
 	}
 
 	return &h
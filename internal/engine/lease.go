@@ -0,0 +1,59 @@
+package engine
+
+/*
+* Route leases.  Gateways announce their routes with a lifetime and send
+* them again every third of it, clients drop routes not renewed in time.  A
+* crashed or unplugged gateway's routes go away even if nothing else
+* notices.  With peers.on_expiry: keep clients leave them in place.
+ */
+import (
+	"log/slog"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+)
+
+const leaseTick = time.Second
+
+/*
+* Go routine renewing our routes with clients.
+ */
+func (pe *ProtocolEngine) leaseRefreshThread() {
+
+	if pe.role == consts.ROLE_CLIENT {
+		return
+	}
+
+	for {
+		time.Sleep(config.Get().LeaseLifetime() / 3)
+		if pe.rm.LearnedCount() > 0 {
+			slog.Debug("renewing route leases")
+			pe.AdvertiseRoutes()
+		}
+	}
+}
+
+/*
+* Go routine expiring routes whose lease ran out.
+ */
+func (pe *ProtocolEngine) leaseExpiryThread() {
+
+	if pe.role == consts.ROLE_GATEWAY {
+		return
+	}
+
+	for {
+		time.Sleep(leaseTick)
+		if config.Get().Peers.OnExpiry == "keep" {
+			continue
+		}
+
+		// DNS settings go with the last of a gateway's routes.
+		for _, owner := range pe.rm.ExpireLeases() {
+			if pe.rm.ClaimCount(owner) == 0 {
+				pe.syncDns(owner, dnsSettings{})
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package engine
+
+/*
+* Tell clients when our tunnel goes away.  While no tunnel is up the state
+* we announce is DOWN with no routes, and a gateway going away announces
+* DOWN on its way out, so clients drop its routes at once instead of
+* waiting for it to time out.
+ */
+import (
+	"log/slog"
+
+	"github.com/code-ointment/link-share/internal/consts"
+)
+
+/*
+* Go routine following tunnel state.
+ */
+func (pe *ProtocolEngine) watchLinks() {
+
+	for {
+		for _, ev := range pe.linkEvents.Wait() {
+			if ev.Tunnel && pe.role != consts.ROLE_CLIENT {
+				pe.tunnelChanged(ev.Name)
+			}
+		}
+	}
+}
+
+func (pe *ProtocolEngine) tunnelChanged(name string) {
+
+	down := !pe.ifm.TunnelsUp()
+
+	pe.mutex.Lock()
+	changed := down != pe.tunnelDown
+	pe.tunnelDown = down
+	pe.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if down {
+		slog.Warn("tunnel down, announcing link down", "tunnel", name)
+	} else {
+		slog.Info("tunnel up, announcing routes", "tunnel", name)
+	}
+	pe.AdvertiseRoutes()
+}
+
+/*
+* Last words of a gateway shutting down.
+ */
+func (pe *ProtocolEngine) announceDown() {
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	if pe.role == consts.ROLE_CLIENT || pe.withdrawn ||
+		pe.generation.Load() == 0 {
+		return
+	}
+
+	slog.Info("shutting down, announcing link down")
+	pe.tunnelDown = true
+	pe.SendAdvertisement(nil)
+	pe.withdrawn = true
+}
@@ -0,0 +1,229 @@
+package engine
+
+/*
+* Peer liveness.  Helos go out every poll interval, jittered so hosts
+* started together don't send in step, and a peer silent for the peer
+* timeout is down.  That leaves clients routing into a dead gateway for
+* minutes, so like BFD a client may ask the gateways it routes through for
+* fast helos.  The client lists them in its helos with the interval it
+* wants, each gateway sends helos at the fastest interval asked of it, but
+* no faster than its min_interval, and says so in its helos.  A gateway that
+* then misses multiplier of them in a row is treated as having withdrawn
+* its routes.
+ */
+import (
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+const livenessTick = 100 * time.Millisecond
+
+/*
+* Take up to the configured jitter off an interval.
+ */
+func jitter(d time.Duration) time.Duration {
+	return d - time.Duration(rand.Float64()*config.Get().Hello.Jitter*float64(d))
+}
+
+/*
+* Time until the next regular helo.
+ */
+func (pe *ProtocolEngine) HeloInterval() time.Duration {
+	return jitter(config.Get().PollInterval)
+}
+
+/*
+* Go routine watching for silent peers, and on clients keeping the fast
+* helo requests in line with the gateways in use.
+ */
+func (pe *ProtocolEngine) livenessThread() {
+
+	for {
+		time.Sleep(livenessTick)
+		pe.HostAccounting()
+		if pe.role != consts.ROLE_GATEWAY && config.Get().Hello.Fast.Enabled {
+			pe.requestFast()
+		}
+	}
+}
+
+/*
+* Go routine sending fast helos while clients ask for them.
+ */
+func (pe *ProtocolEngine) fastHeloThread() {
+
+	if pe.role == consts.ROLE_CLIENT || !config.Get().Hello.Fast.Enabled {
+		return
+	}
+
+	for {
+		pe.mutex.Lock()
+		interval := pe.fastIntervalLocked()
+		pe.mutex.Unlock()
+
+		if interval == 0 {
+			time.Sleep(livenessTick)
+			continue
+		}
+		pe.sendHelo(link_proto.HeloRequest_HELO)
+		time.Sleep(jitter(interval))
+	}
+}
+
+/*
+* Fastest helo interval live clients ask of us, 0 for none.  Called with
+* the object lock held.
+ */
+func (pe *ProtocolEngine) fastIntervalLocked() time.Duration {
+
+	fast := config.Get().Hello.Fast
+	if !fast.Enabled || pe.role == consts.ROLE_CLIENT {
+		return 0
+	}
+
+	var interval time.Duration
+	for _, h := range pe.hosts {
+		if h.State != consts.UP || h.FastWanted == 0 {
+			continue
+		}
+		if interval == 0 || h.FastWanted < interval {
+			interval = h.FastWanted
+		}
+	}
+	if interval != 0 && interval < fast.MinInterval {
+		interval = fast.MinInterval
+	}
+	return interval
+}
+
+/*
+* Gateways our installed routes go through.
+ */
+func (pe *ProtocolEngine) gatewaysInUse() []string {
+
+	ids := []string{}
+	for _, rt := range pe.rm.GetSelfRoutes() {
+		if rt.Owner != "" && !slices.Contains(ids, rt.Owner) {
+			ids = append(ids, rt.Owner)
+		}
+		for _, h := range rt.Hops {
+			if !slices.Contains(ids, h.Owner) {
+				ids = append(ids, h.Owner)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+/*
+* Ask for fast helos from the gateways in use, telling them at once when
+* that changes.
+ */
+func (pe *ProtocolEngine) requestFast() {
+
+	ids := gatewaysKey(pe.gatewaysInUse())
+
+	pe.mutex.Lock()
+	if ids == gatewaysKey(pe.fastAsked) {
+		pe.mutex.Unlock()
+		return
+	}
+
+	// Gateways we stop asking go back to the peer timeout.
+	asked := strings.Fields(ids)
+	for _, h := range pe.hosts {
+		if !slices.Contains(asked, h.ID) {
+			h.FastInterval = 0
+		}
+	}
+	pe.fastAsked = asked
+	pe.mutex.Unlock()
+
+	slog.Info("requesting fast helos", "gateways", asked,
+		"interval", config.Get().Hello.Fast.Interval)
+	pe.sendHelo(link_proto.HeloRequest_HELO)
+}
+
+func gatewaysKey(ids []string) string {
+	return strings.Join(ids, " ")
+}
+
+/*
+* Fill in the fast helo fields.  Called with the object lock held.
+ */
+func (pe *ProtocolEngine) describeFast(helo *link_proto.Helo) {
+
+	if len(pe.fastAsked) > 0 {
+		helo.FastPeers = pe.fastAsked
+		helo.FastRequest = uint32(config.Get().Hello.Fast.Interval.Milliseconds())
+	}
+	helo.FastInterval = uint32(pe.fastIntervalLocked().Milliseconds())
+}
+
+/*
+* Record the host's fast helo request of us, and the interval it sends fast
+* helos at if we asked it to.  Called with the object lock held.
+ */
+func (pe *ProtocolEngine) noteFast(h *Host, hi *link_proto.Helo) {
+
+	h.FastWanted = 0
+	if slices.Contains(hi.GetFastPeers(), pe.sender) {
+		h.FastWanted = time.Duration(hi.GetFastRequest()) * time.Millisecond
+	}
+
+	interval := time.Duration(hi.GetFastInterval()) * time.Millisecond
+	if !slices.Contains(pe.fastAsked, h.ID) {
+		interval = 0
+	}
+	if interval != h.FastInterval {
+		slog.Info("fast helos", "host", h.ID, "interval", interval)
+	}
+	h.FastInterval = interval
+}
+
+/*
+* How long the host may stay silent, and whether that's the fast helo
+* interval.
+ */
+func deadInterval(h *Host) (time.Duration, bool) {
+
+	cfg := config.Get()
+	if cfg.Hello.Fast.Enabled && h.FastInterval > 0 {
+		return time.Duration(cfg.Hello.Fast.Multiplier) * h.FastInterval, true
+	}
+	return cfg.PeerTimeout(), false
+}
+
+/*
+* A gateway that missed its fast helos goes the way of one that withdrew.
+* Its generation is forgotten, so its next helo brings a resync.
+ */
+func (pe *ProtocolEngine) gatewayFailed(h *Host) {
+
+	pe.mutex.Lock()
+	h.Generation = 0
+	h.FastInterval = 0
+	pe.mutex.Unlock()
+
+	slog.Warn("gateway missed fast helos, removing its routes", "host", h.ID,
+		"routes", pe.rm.ClaimCount(h.ID))
+	pe.dropGateway(h.ID)
+}
+
+/*
+* Remove every route and the DNS settings the gateway provided.
+ */
+func (pe *ProtocolEngine) dropGateway(id string) {
+
+	pe.rm.SyncRoutes(id, nil)
+	pe.syncDns(id, dnsSettings{})
+}
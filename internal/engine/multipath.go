@@ -0,0 +1,55 @@
+package engine
+
+/*
+* Multipath.  With it enabled a client sends traffic for a route over every
+* live gateway of the best priority offering it, in proportion to the
+* weights they announce.  Gateways coming and going change the next hops of
+* the route in place.
+ */
+import (
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+)
+
+/*
+* Spreader handed to the route manager.  Returns nil, leaving the choice to
+* the election, unless there are at least two gateways to spread over.
+ */
+func (pe *ProtocolEngine) spread(dest string, owners []string) map[string]int {
+
+	if !config.Get().Multipath.Enabled {
+		return nil
+	}
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	best := uint32(0)
+	live := []*Host{}
+	for _, o := range owners {
+		h := pe.findHost(o)
+		if h == nil || h.State != consts.UP {
+			continue
+		}
+		live = append(live, h)
+		if h.Priority > best {
+			best = h.Priority
+		}
+	}
+
+	weights := map[string]int{}
+	for _, h := range live {
+		if h.Priority != best {
+			continue
+		}
+		weights[h.ID] = 1
+		if h.Weight > 0 {
+			weights[h.ID] = int(h.Weight)
+		}
+	}
+
+	if len(weights) < 2 {
+		return nil
+	}
+	return weights
+}
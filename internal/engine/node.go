@@ -0,0 +1,180 @@
+package engine
+
+/*
+* Node identity.  Each host has a random UUID, kept on disk so it survives
+* restarts, address changes and renames.  It is the sender in packet headers
+* and peers are tracked by it.  Helos add what an operator wants to know
+* about the node.
+ */
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+const maxPeerAddrs = 8
+
+var uuidExp = regexp.MustCompile(
+	`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+/*
+* Read the node id, creating one the first time.
+ */
+func loadNodeID(path string) (string, error) {
+
+	if b, err := os.ReadFile(path); err == nil {
+		id := strings.TrimSpace(string(b))
+		if uuidExp.MatchString(id) {
+			return id, nil
+		}
+		slog.Warn("invalid node id, replacing it", "path", path, "id", id)
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	slog.Info("created node id", "id", id, "path", path)
+	return id, nil
+}
+
+/*
+* Random, version 4, UUID.
+ */
+func newUUID() (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:16]), nil
+}
+
+/*
+* Protocol features this build speaks.
+ */
+const capabilities = uint32(link_proto.Capability_CAP_SETS |
+	link_proto.Capability_CAP_GENERATIONS |
+	link_proto.Capability_CAP_ELECTION |
+	link_proto.Capability_CAP_MULTIPATH |
+	link_proto.Capability_CAP_SPLIT_DNS |
+	link_proto.Capability_CAP_LEASES |
+	link_proto.Capability_CAP_IPV4 |
+	link_proto.Capability_CAP_HEALTH |
+	link_proto.Capability_CAP_FAST_HELO)
+
+/*
+* Names of the capability bits set in caps.
+ */
+func capabilityNames(caps uint32) []string {
+
+	names := []string{}
+	for bit := uint32(1); bit != 0 && bit <= caps; bit <<= 1 {
+		if caps&bit == 0 {
+			continue
+		}
+		name, ok := link_proto.Capability_name[int32(bit)]
+		if !ok {
+			name = fmt.Sprintf("0x%x", bit)
+		}
+		names = append(names, strings.ToLower(strings.TrimPrefix(name, "CAP_")))
+	}
+	return names
+}
+
+/*
+* Fill in who we are.
+ */
+func (pe *ProtocolEngine) describe(helo *link_proto.Helo) {
+
+	helo.NodeId = pe.sender
+	helo.Hostname = pe.hostname
+	helo.Version = consts.Version
+	helo.Role = pe.role.String()
+	helo.Uptime = uint64(time.Since(pe.started).Seconds())
+	helo.Capabilities = capabilities
+}
+
+/*
+* Record what a helo says about the host.  Called with the object lock
+* held.
+ */
+func (h *Host) learn(hi *link_proto.Helo) {
+
+	if hi.GetNodeId() != "" && hi.GetNodeId() != h.ID {
+		slog.Warn("helo node id differs from sender", "sender", h.ID,
+			"node id", hi.GetNodeId())
+	}
+	h.Hostname = hi.GetHostname()
+	h.Version = hi.GetVersion()
+	h.Role = hi.GetRole()
+	h.Capabilities = hi.GetCapabilities()
+	// Older versions send neither.
+	if hi.GetVersion() != "" {
+		h.Started = time.Now().Add(-time.Duration(hi.GetUptime()) * time.Second)
+	}
+
+	// The address it advertises follows DHCP and address changes.
+	ip := net.ParseIP(hi.GetIpaddr())
+	if ip != nil {
+		h.IP = ip
+	}
+	h.noteAddr(ip)
+}
+
+/*
+* Remember an address the host uses, latest first.  Addresses not heard
+* from for the peer timeout are forgotten, and only the latest
+* maxPeerAddrs kept.  Called with the object lock held.
+ */
+func (h *Host) noteAddr(ip net.IP) {
+
+	if ip == nil {
+		return
+	}
+	if h.IP == nil {
+		h.IP = ip
+	}
+
+	now := time.Now()
+	timeout := config.Get().PeerTimeout()
+	addrs := []PeerAddr{{IP: ip, Seen: now}}
+	for _, a := range h.Addrs {
+		if a.IP.Equal(ip) || now.Sub(a.Seen) > timeout ||
+			len(addrs) >= maxPeerAddrs {
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+	h.Addrs = addrs
+}
+
+/*
+* Host name for display, the node id when the host hasn't said.
+ */
+func (h *Host) Name() string {
+
+	if h.Hostname != "" {
+		return h.Hostname
+	}
+	return h.ID
+}
@@ -0,0 +1,151 @@
+package engine
+
+/*
+* Packet encoding shared by all senders and the listener.  Gateways with an
+* identity sign every packet, so their helos can't be forged either.  When a
+* key is configured packets are sealed on the way out and must be sealed on
+* the way in.
+ */
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/code-ointment/link-share/internal/auth"
+	"github.com/code-ointment/link-share/link_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+var errUnauthenticated = errors.New("unauthenticated packet")
+
+/*
+* Marshal and, when configured, sign and seal a packet.
+ */
+func (pe *ProtocolEngine) encode(pkt *link_proto.Packet) ([]byte, error) {
+
+	pe.stamp(pkt)
+	out, err := proto.Marshal(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	if pe.identity != nil {
+		signed := link_proto.Packet{
+			Pkttype: &link_proto.Packet_Signed{Signed: &link_proto.Signed{
+				Packet:    out,
+				PublicKey: pe.identity.PublicKey(),
+				Signature: pe.identity.Sign(out),
+			}},
+		}
+		if out, err = proto.Marshal(&signed); err != nil {
+			return nil, err
+		}
+	}
+
+	if pe.keyring == nil {
+		return out, nil
+	}
+
+	sealed, err := pe.keyring.Seal(out)
+	if err != nil {
+		return nil, err
+	}
+	outer := link_proto.Packet{
+		Pkttype: &link_proto.Packet_Sealed{Sealed: sealed},
+	}
+	return proto.Marshal(&outer)
+}
+
+/*
+* Unmarshal, opening sealed packets and checking signatures.  Packets that
+* fail authentication, or arrive in the clear while a key is configured, are
+* counted and refused.  The signer's key is returned for signed packets.
+ */
+func (pe *ProtocolEngine) decode(buf []byte) (*link_proto.Packet, []byte, error) {
+
+	packet, err := pe.open(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signed := packet.GetSigned()
+	if signed == nil {
+		return packet, nil, nil
+	}
+
+	if !auth.Verify(signed.GetPublicKey(), signed.GetPacket(),
+		signed.GetSignature()) {
+		pe.signatureRejects.Add(1)
+		return nil, nil, errors.New("bad signature")
+	}
+
+	inner := link_proto.Packet{}
+	if err := proto.Unmarshal(signed.GetPacket(), &inner); err != nil {
+		pe.signatureRejects.Add(1)
+		return nil, nil, err
+	}
+	if inner.GetHelo() == nil && inner.GetAnnounce() == nil {
+		pe.signatureRejects.Add(1)
+		return nil, nil, errors.New("signed packet wraps no payload")
+	}
+	return &inner, signed.GetPublicKey(), nil
+}
+
+func (pe *ProtocolEngine) open(buf []byte) (*link_proto.Packet, error) {
+
+	packet := link_proto.Packet{}
+	if err := proto.Unmarshal(buf, &packet); err != nil {
+		return nil, err
+	}
+
+	sealed := packet.GetSealed()
+	if pe.keyring == nil {
+		if sealed != nil {
+			pe.unauthenticated.Add(1)
+			return nil, errors.New("sealed packet but no key configured")
+		}
+		return &packet, nil
+	}
+
+	if sealed == nil {
+		pe.unauthenticated.Add(1)
+		return nil, errUnauthenticated
+	}
+
+	plain, err := pe.keyring.Open(sealed)
+	if err != nil {
+		pe.authFailures.Add(1)
+		return nil, err
+	}
+
+	inner := link_proto.Packet{}
+	if err := proto.Unmarshal(plain, &inner); err != nil {
+		pe.authFailures.Add(1)
+		return nil, err
+	}
+	if inner.GetSealed() != nil {
+		pe.authFailures.Add(1)
+		return nil, errors.New("nested sealed packet")
+	}
+	return &inner, nil
+}
+
+/*
+* Encode a packet and write it to the group of each of the connection's
+* transports.  The copies are identical, so a peer hearing both drops the
+* second as a duplicate.
+ */
+func (pe *ProtocolEngine) sendPacket(c *ConnectionCtx, pkt *link_proto.Packet) {
+
+	out, err := pe.encode(pkt)
+	if err != nil {
+		slog.Error("Failed marshaling", "error", err)
+		return
+	}
+
+	for _, t := range c.Transports {
+		if err := t.PktConn.WriteTo(out, c.Intf.Index, t.Group); err != nil {
+			slog.Error("failed writing", "transport", t.Transport,
+				"error", err)
+		}
+	}
+}
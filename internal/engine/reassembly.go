@@ -0,0 +1,107 @@
+package engine
+
+/*
+* Put announcement sets sent in several parts back together.  Parts are
+* kept per host until the set is complete, incomplete sets are dropped
+* after pendingTimeout or when too many are outstanding.
+ */
+import (
+	"log/slog"
+	"time"
+
+	"github.com/code-ointment/link-share/link_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	maxParts       uint32 = 64
+	maxPendingSets int    = 8
+	pendingTimeout        = 10 * time.Second
+)
+
+type pendingSet struct {
+	parts   []*link_proto.Announce
+	have    int
+	started time.Time
+}
+
+/*
+* Return the whole set once the last part of it arrives, nil until then.
+* Unfragmented announcements are returned as is.
+ */
+func (pe *ProtocolEngine) reassemble(h *Host,
+	an *link_proto.Announce) *link_proto.Announce {
+
+	if an.GetParts() <= 1 {
+		return an
+	}
+
+	if an.GetParts() > maxParts || an.GetPart() >= an.GetParts() {
+		slog.Warn("bad announcement part", "host", h.ID,
+			"part", an.GetPart(), "parts", an.GetParts())
+		return nil
+	}
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	now := time.Now()
+	h.prunePending(now)
+
+	id := an.GetSetId()
+	ps := h.Pending[id]
+	if ps == nil {
+		if len(h.Pending) >= maxPendingSets {
+			slog.Warn("too many incomplete announcement sets", "host", h.ID)
+			return nil
+		}
+		ps = &pendingSet{
+			parts:   make([]*link_proto.Announce, an.GetParts()),
+			started: now,
+		}
+		h.Pending[id] = ps
+	}
+
+	if len(ps.parts) != int(an.GetParts()) {
+		slog.Warn("announcement part count changed, dropping set",
+			"host", h.ID, "set", id)
+		delete(h.Pending, id)
+		return nil
+	}
+
+	if ps.parts[an.GetPart()] == nil {
+		ps.have++
+	}
+	ps.parts[an.GetPart()] = an
+
+	if ps.have < len(ps.parts) {
+		slog.Debug("waiting for announcement parts", "host", h.ID,
+			"set", id, "have", ps.have, "parts", len(ps.parts))
+		return nil
+	}
+	delete(h.Pending, id)
+
+	whole := proto.Clone(ps.parts[0]).(*link_proto.Announce)
+	whole.Part = 0
+	whole.Parts = 1
+	for _, p := range ps.parts[1:] {
+		whole.Routes = append(whole.Routes, p.GetRoutes()...)
+	}
+	slog.Debug("announcement set complete", "host", h.ID, "set", id,
+		"parts", len(ps.parts), "routes", len(whole.Routes))
+	return whole
+}
+
+/*
+* Forget sets whose missing parts never showed up.
+ */
+func (h *Host) prunePending(now time.Time) {
+
+	for id, ps := range h.Pending {
+		if now.Sub(ps.started) > pendingTimeout {
+			slog.Warn("incomplete announcement set expired", "host", h.ID,
+				"set", id, "have", ps.have, "parts", len(ps.parts))
+			delete(h.Pending, id)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package engine
+
+/*
+* Replay protection.  Each sender stamps packets with its start time
+* (epoch), a sequence number and the send time.  Receivers keep a sliding
+* window per host, as IPsec does, so duplicates and packets older than the
+* window are refused.  A higher epoch means the sender restarted and resets
+* the window, a lower one is a replay from an earlier run.  With
+* security.max_packet_age set, the send time bounds how old a packet may be,
+* which covers receivers that restarted and lost their windows but needs
+* the hosts' clocks in sync.
+*
+* The sender id is only a claim.  Once a trusted signed announcement comes
+* from a sender, its id is bound to the signing key and packets under that
+* id not signed with it are refused before they reach the window, so a
+* forged helo can't push the window out of the real sender's reach.  The
+* first binding starts the window afresh, dropping whatever unsigned
+* packets set it to.
+ */
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/events"
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+const replayWindowSize uint64 = 64
+
+var errDuplicate = errors.New("duplicate sequence")
+var errPacketAge = errors.New("packet age outside max_packet_age")
+var errWrongSigner = errors.New("sender is bound to another key")
+
+type ReplayWindow struct {
+	epoch   uint64
+	highest uint64 // highest sequence accepted
+	bitmap  uint64 // bit n set means highest-n was seen
+}
+
+/*
+* Accept the packet and slide the window, or refuse it.
+ */
+func (rw *ReplayWindow) Accept(epoch uint64, seq uint64) error {
+
+	if epoch < rw.epoch {
+		return fmt.Errorf("stale epoch %d, current %d", epoch, rw.epoch)
+	}
+
+	if epoch > rw.epoch {
+		rw.epoch = epoch
+		rw.highest = seq
+		rw.bitmap = 1
+		return nil
+	}
+
+	if seq > rw.highest {
+		shift := seq - rw.highest
+		if shift >= replayWindowSize {
+			rw.bitmap = 1
+		} else {
+			rw.bitmap = rw.bitmap<<shift | 1
+		}
+		rw.highest = seq
+		return nil
+	}
+
+	offset := rw.highest - seq
+	if offset >= replayWindowSize {
+		return fmt.Errorf("sequence %d too old, highest %d", seq, rw.highest)
+	}
+	if rw.bitmap&(1<<offset) != 0 {
+		return fmt.Errorf("%w %d", errDuplicate, seq)
+	}
+	rw.bitmap |= 1 << offset
+	return nil
+}
+
+/*
+* Stamp an outgoing packet.
+ */
+func (pe *ProtocolEngine) stamp(pkt *link_proto.Packet) {
+
+	pkt.Header = &link_proto.Header{
+		Sender:   pe.sender,
+		Epoch:    pe.epoch,
+		Sequence: pe.sequence.Add(1),
+		Sent:     time.Now().UnixMilli(),
+	}
+}
+
+/*
+* Check the header against the sender's window, returning the sender's host
+* entry and whether it is new to us.  Refused packets are counted.  signer
+* is the key the packet was signed with, if any, and bind ties the sender to
+* it once the signature has been trusted.
+ */
+func (pe *ProtocolEngine) checkReplay(hdr *link_proto.Header, signer []byte,
+	bind bool) (*Host, bool, error) {
+
+	if hdr == nil || hdr.GetSender() == "" {
+		pe.replayRejects.Add(1)
+		return nil, false, fmt.Errorf("no replay header")
+	}
+
+	// Our own packet coming back, looped or replayed.
+	if hdr.GetSender() == pe.sender {
+		pe.replayRejects.Add(1)
+		return nil, false, fmt.Errorf("packet claims to be from us")
+	}
+
+	maxAge := config.Get().Security.MaxPacketAge
+	if maxAge > 0 {
+		age := time.Since(time.UnixMilli(hdr.GetSent()))
+		if age > maxAge || age < -maxAge {
+			pe.replayRejects.Add(1)
+			return nil, false, fmt.Errorf("%w, %s against %s", errPacketAge,
+				age.Round(time.Millisecond), maxAge)
+		}
+	}
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	h := pe.findHost(hdr.GetSender())
+	isNew := h == nil
+	if isNew {
+		h = NewHost(hdr.GetSender())
+	}
+
+	if h.Signer != nil && !bytes.Equal(h.Signer, signer) {
+		pe.signatureRejects.Add(1)
+		return nil, false, errWrongSigner
+	}
+	bind = bind && signer != nil && h.Signer == nil
+	if bind {
+		h.Replay = ReplayWindow{}
+	}
+
+	if err := h.Replay.Accept(hdr.GetEpoch(), hdr.GetSequence()); err != nil {
+		// A second copy over the other transport isn't a replay.
+		if !errors.Is(err, errDuplicate) {
+			pe.replayRejects.Add(1)
+		}
+		return nil, false, err
+	}
+	if bind {
+		h.Signer = signer
+		slog.Debug("sender bound to its signing key", "host", h.ID)
+	}
+
+	if isNew {
+		pe.hosts = append(pe.hosts, h)
+		slog.Debug("new host", "host", h.ID)
+		pe.bus.Publish(events.Event{Kind: events.PeerJoined, Name: h.ID})
+	}
+	return h, isNew, nil
+}
@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/events"
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+type replayStep struct {
+	epoch uint64
+	seq   uint64
+	ok    bool
+}
+
+func TestReplayWindow(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		steps []replayStep
+	}{
+		{
+			name: "in order",
+			steps: []replayStep{
+				{100, 1, true}, {100, 2, true}, {100, 3, true},
+			},
+		},
+		{
+			name: "duplicate",
+			steps: []replayStep{
+				{100, 1, true}, {100, 2, true}, {100, 2, false},
+				{100, 1, false}, {100, 3, true}, {100, 3, false},
+			},
+		},
+		{
+			name: "out of order within the window",
+			steps: []replayStep{
+				{100, 10, true}, {100, 70, true}, {100, 40, true},
+				{100, 7, true}, {100, 69, true}, {100, 40, false},
+				{100, 7, false},
+			},
+		},
+		{
+			name: "too old",
+			steps: []replayStep{
+				{100, 1, true}, {100, 100, true}, {100, 36, false},
+				{100, 37, true}, {100, 2, false},
+			},
+		},
+		{
+			name: "jump past the window",
+			steps: []replayStep{
+				{100, 1, true}, {100, 2, true}, {100, 1000, true},
+				{100, 999, true}, {100, 2, false}, {100, 1000, false},
+			},
+		},
+		{
+			name: "new epoch restarts the sequence",
+			steps: []replayStep{
+				{100, 5000, true}, {100, 5001, true}, {200, 1, true},
+				{200, 2, true}, {200, 1, false}, {100, 5002, false},
+			},
+		},
+		{
+			name: "sequence wraps into a new epoch",
+			steps: []replayStep{
+				{100, ^uint64(0) - 1, true}, {100, ^uint64(0), true},
+				{100, 0, false}, {101, 0, true}, {101, 1, true},
+				{100, 0, false},
+			},
+		},
+		{
+			name: "lower epoch refused",
+			steps: []replayStep{
+				{200, 1, true}, {100, 1, false}, {100, 2, false},
+				{200, 2, true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var rw ReplayWindow
+			for i, s := range tt.steps {
+				err := rw.Accept(s.epoch, s.seq)
+				if (err == nil) != s.ok {
+					t.Fatalf("step %d epoch %d seq %d: ok %t, got err %v",
+						i, s.epoch, s.seq, s.ok, err)
+				}
+			}
+		})
+	}
+}
+
+/*
+* A packet under the gateway's sender id, from the gateway or forged.
+ */
+type senderStep struct {
+	name   string
+	epoch  uint64
+	seq    uint64
+	signer string // "" unsigned
+	bind   bool   // a trusted announcement
+	err    error  // nil when accepted
+}
+
+func TestSpoofedSender(t *testing.T) {
+
+	err := config.Load(filepath.Join(t.TempDir(), "none.yaml"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	max := ^uint64(0)
+	tests := []struct {
+		name  string
+		steps []senderStep
+		epoch uint64 // of the window once done
+	}{
+		{
+			name: "forged helos can't move a bound window",
+			steps: []senderStep{
+				{"announcement", 100, 1, "gw", true, nil},
+				{"unsigned helo", max, 1, "", false, errWrongSigner},
+				{"helo signed by another key", max, 1, "other", false,
+					errWrongSigner},
+				{"announcement by another key", max, 1, "other", true,
+					errWrongSigner},
+				{"gateway helo", 100, 2, "gw", false, nil},
+				{"gateway announcement", 100, 3, "gw", true, nil},
+			},
+			epoch: 100,
+		},
+		{
+			name: "binding drops a window forged before it",
+			steps: []senderStep{
+				{"unsigned helo", max, 1, "", false, nil},
+				{"announcement", 100, 1, "gw", true, nil},
+				{"unsigned helo", max, 2, "", false, errWrongSigner},
+				{"gateway helo", 100, 2, "gw", false, nil},
+			},
+			epoch: 100,
+		},
+		{
+			name: "signed helos alone don't bind",
+			steps: []senderStep{
+				{"helo", 100, 1, "gw", false, nil},
+				{"unsigned helo", 100, 2, "", false, nil},
+			},
+			epoch: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pe := &ProtocolEngine{sender: "me", bus: events.NewBus()}
+			for i, s := range tt.steps {
+				hdr := &link_proto.Header{Sender: "gw", Epoch: s.epoch,
+					Sequence: s.seq}
+				var signer []byte
+				if s.signer != "" {
+					signer = []byte(s.signer)
+				}
+				_, _, err := pe.checkReplay(hdr, signer, s.bind)
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d %s: got %v, want %v", i, s.name, err,
+						s.err)
+				}
+			}
+
+			if h := pe.findHost("gw"); h == nil || h.Replay.epoch != tt.epoch {
+				t.Fatalf("window epoch not %d", tt.epoch)
+			}
+		})
+	}
+}
@@ -1,54 +1,67 @@
 package engine
 
 /*
-* Handles Annoucements.  Not a lot just yet.
+* Handles Annoucements.
  */
 import (
 	"log/slog"
 
+	"github.com/code-ointment/link-share/internal/consts"
 	"github.com/code-ointment/link-share/link_proto"
-	"golang.org/x/sys/unix"
 )
 
-func (pe *ProtocolEngine) AnnounceHandler(an *link_proto.Announce) {
+/*
+* Bring our routes and DNS settings in line with the gateway's state.  Sets
+* from a generation older than one already applied are ignored.
+ */
+func (pe *ProtocolEngine) AnnounceHandler(h *Host, an *link_proto.Announce) {
+
+	if pe.role == consts.ROLE_GATEWAY {
+		slog.Debug("gateway role, ignoring announcement", "gw", an.GetGateway())
+		return
+	}
 
-	rts := an.GetRoutes()
 	gw := an.GetGateway()
-	domain := an.GetDomain()
-	ns := an.GetNameservers()
-	sd := an.GetSearchdomains()
+	gen := an.GetGeneration()
+	if gen == 0 {
+		slog.Warn("announcement without a generation, gateway runs an older version",
+			"gw", gw)
+		return
+	}
 
-	slog.Info("dns config",
-		"nameservers", ns,
-		"searchdomains", sd)
-	pe.configured = true // switch to atomic variable
-
-	for _, rt := range rts {
-
-		slog.Info("Announce Update", "op", rt.Op)
-		if rt.Op == unix.RTM_NEWROUTE {
-			slog.Info("add route ",
-				"gw", gw, "dst", rt.Dest, "domain", domain)
-
-			// hmmm...
-			if pe.rm.AddRoute(rt.Dest, gw) {
-
-				intf := pe.ifm.GetDefaultLink()
-				if pe.dnsConfig.BackupConfig() {
-					pe.dnsConfig.SetNameServers(intf.Attrs().Name, ns)
-					pe.dnsConfig.SetDomains(intf.Attrs().Name, sd)
-					pe.dnsConfig.Commit()
-				}
-			}
-		}
-
-		if rt.Op == unix.RTM_DELROUTE {
-			slog.Info("delete route ",
-				"gw", gw, "dst", rt.Dest, "domain", domain)
-			// hmmm...
-			if pe.rm.DeleteRoute(rt.Dest, gw) {
-				pe.dnsConfig.RestoreConfig()
-			}
-		}
+	pe.mutex.Lock()
+	if pe.withdrawn {
+		pe.mutex.Unlock()
+		slog.Debug("withdrawn, ignoring announcement", "gw", gw)
+		return
+	}
+	current := h.acceptGeneration(gen)
+	if current {
+		h.Health = an.GetHealth()
 	}
+	if current && an.GetLstate() == link_proto.LinkState_UP {
+		h.markAlive(an.GetPriority())
+		h.Weight = an.GetWeight()
+	}
+	pe.mutex.Unlock()
+	if !current {
+		slog.Debug("stale generation, ignoring", "host", h.ID,
+			"generation", gen)
+		return
+	}
+
+	if an.GetLstate() == link_proto.LinkState_DOWN {
+		slog.Warn("gateway link down, removing its routes", "host", h.ID,
+			"gw", gw)
+	}
+
+	slog.Info("dns config",
+		"nameservers", an.GetNameservers(),
+		"searchdomains", an.GetSearchdomains())
+	pe.mutex.Lock()
+	pe.configured = true
+	pe.mutex.Unlock()
+	pe.pickRole(consts.ROLE_CLIENT, "announcement received from "+gw)
+
+	pe.reconcile(h, an)
 }
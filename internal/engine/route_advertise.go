@@ -7,11 +7,14 @@ package engine
 import (
 	"log/slog"
 	"net"
-	"os"
+	"strings"
+	"time"
 
+	"github.com/code-ointment/link-share/internal/config"
 	"github.com/code-ointment/link-share/internal/consts"
 	"github.com/code-ointment/link-share/internal/inet"
 	"github.com/code-ointment/link-share/link_proto"
+	"golang.org/x/sys/unix"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -20,14 +23,21 @@ import (
  */
 func (pe *ProtocolEngine) AdvertiseUpdates() {
 
+	// Clients have nothing of their own to share.
+	if pe.role == consts.ROLE_CLIENT {
+		return
+	}
+
 	// Advertise routes the router manager found on initialization.
 	if pe.rm.LearnedCount() > 0 {
 		pe.AdvertiseRoutes()
 	}
 
-	// Wait for an update and advertise.
+	// Wait for a change and advertise the table once the burst settles.
 	for {
-		pe.rm.WaitForUpdate()
+		evs := pe.routeEvents.WaitSettled(200*time.Millisecond, 2*time.Second)
+		slog.Debug("learned routes changed", "events", len(evs))
+		pe.damper.note(evs)
 		pe.AdvertiseRoutes()
 	}
 }
@@ -37,15 +47,25 @@ func (pe *ProtocolEngine) AdvertiseUpdates() {
  */
 func (pe *ProtocolEngine) AdvertiseRoutes() {
 
+	if pe.withdrawn {
+		slog.Info("routes withdrawn, not advertising")
+		return
+	}
+
 	rts := pe.rm.GetRouteUpdates()
 	pe.dnsConfig.ReadConfig()
 
+	// Never learned a tunnel route, nothing to publish.
+	if len(rts) == 0 {
+		return
+	}
+	rts = pe.damper.filter(rts)
+
 	pe.mutex.Lock()
 	defer pe.mutex.Unlock()
 
-	for _, rt := range rts {
-		pe.SendAdvertisement(&rt)
-	}
+	pe.SendAdvertisement(rts)
+	pe.pickRole(consts.ROLE_GATEWAY, "tunnel routes learned on "+rts[0].Ifname)
 }
 
 /*
@@ -53,65 +73,187 @@ func (pe *ProtocolEngine) AdvertiseRoutes() {
  */
 func (pe *ProtocolEngine) AdvertiseRoutesUL() {
 
+	if pe.withdrawn {
+		return
+	}
+
 	rts := pe.rm.GetRouteUpdates()
+	if len(rts) == 0 {
+		return
+	}
+	rts = pe.damper.filter(rts)
 	pe.dnsConfig.ReadConfig()
 
-	for _, rt := range rts {
-		pe.SendAdvertisement(&rt)
-	}
+	pe.SendAdvertisement(rts)
 }
 
 /*
-* Send advertisement.  Destination fetched from route update  - presumably
-* the VPN link.  Gateway is the local host.
+* Room left in a datagram for the packet header, signature and seal.
+ */
+const announceOverhead = 256
+
+/*
+* Publish the routes still present, the desired state, as one set on every
+* connection.  Destination fetched from route update  - presumably the VPN
+* link.  Gateway is the local host.  Sets too large for one datagram go out
+* in parts the clients put back together.  An empty set tells clients to
+* drop everything they have through us.  Called with the object lock held.
  */
-func (pe *ProtocolEngine) SendAdvertisement(rt *inet.RouteUpdate) {
+func (pe *ProtocolEngine) SendAdvertisement(rts []inet.RouteUpdate) {
+
+	// With the tunnel down or dead we have nothing to offer.
+	lstate := link_proto.LinkState_UP
+	if pe.tunnelDown || pe.healthWithdrawn() {
+		lstate = link_proto.LinkState_DOWN
+		rts = nil
+	}
+
+	live := []inet.RouteUpdate{}
+	for _, rt := range rts {
+		if rt.Op == unix.RTM_NEWROUTE {
+			live = append(live, rt)
+		}
+	}
 
-	mgroup := net.ParseIP(consts.GroupAddr)
-	dst := &net.UDPAddr{IP: mgroup, Port: consts.ListenPort}
+	cfg := config.Get()
 
-	for _, c := range pe.connections {
+	nameservers := ""
+	searchdomains := ""
+	var dnsRoutes []*link_proto.DnsRoute
+	if cfg.Dns.Advertise && len(live) > 0 {
+		ifname := live[0].Ifname
+		nameservers = pe.dnsConfig.GetNameServers(ifname)
+		searchdomains = pe.dnsConfig.GetDomains(ifname)
+		dnsRoutes = advertisedDnsRoutes(nameservers, searchdomains)
+	}
 
-		var me net.IP
+	lifetime := uint32(cfg.LeaseLifetime().Seconds())
+	mtus := map[string]uint32{}
+	routes := make([]*link_proto.Route, 0, len(live))
+	for _, rt := range live {
 
-		// Advertise IPv4 routes using an IPv4 gateway address
-		if len(rt.Dst.IP) == int(net.IPv4len) {
-			me = c.GetIPv4Addr()
-		} else {
-			me = c.GetIPv6Addr()
+		// Clients keep packets within the tunnel's MTU.
+		mtu, ok := mtus[rt.Ifname]
+		if !ok && cfg.Mtu.Advertise {
+			mtu = uint32(pe.ifm.LinkMTU(rt.Ifname))
+			mtus[rt.Ifname] = mtu
 		}
-		slog.Info("advertise", "me", me,
-			"op", rt.Op, "dst", inet.IPNetToCidr(&rt.Dst),
-			"ifname", rt.Ifname,
-			"nameserver", pe.dnsConfig.GetNameServers(rt.Ifname))
-
-		route := link_proto.Route{
-			Op:   int32(rt.Op),
-			Dest: inet.IPNetToCidr(&rt.Dst),
+
+		slog.Debug("advertise route",
+			"dst", inet.IPNetToCidr(&rt.Dst), "ifname", rt.Ifname, "mtu", mtu)
+		routes = append(routes, &link_proto.Route{
+			Op:       unix.RTM_NEWROUTE,
+			Dest:     inet.IPNetToCidr(&rt.Dst),
+			Lifetime: lifetime,
+			Mtu:      mtu,
+		})
+	}
+	gen := pe.publish(lstate, routes, nameservers, searchdomains, dnsRoutes)
+
+	for i := range pe.connections {
+
+		c := &pe.connections[i]
+
+		// IPv4 routes use an IPv4 gateway address, IPv6 routes gateway6.
+		me6 := c.GetIPv6Addr()
+		me := c.GetIPv4Addr()
+		if me == nil {
+			me = me6
 		}
-		announce := link_proto.Announce{
-			Lstate:        link_proto.LinkState_UP,
+
+		set := link_proto.Announce{
+			Lstate:        lstate,
 			Gateway:       me.String(),
+			Gateway6:      ipString(me6),
 			Domain:        pe.domain,
-			Nameservers:   pe.dnsConfig.GetNameServers(rt.Ifname),
-			Searchdomains: pe.dnsConfig.GetDomains(rt.Ifname),
-			Routes:        []*link_proto.Route{&route},
+			Nameservers:   nameservers,
+			Searchdomains: searchdomains,
+			DnsRoutes:     dnsRoutes,
+			SetId:         pe.setID.Add(1),
+			Generation:    gen,
+			Priority:      pe.priority(),
+			Weight:        uint32(config.Get().Multipath.Weight),
+			Health:        pe.health(),
 		}
+		parts := splitAnnounce(&set, routes, announceLimit(c))
 
-		pph := link_proto.Packet_Announce{Announce: &announce}
-		pkt := link_proto.Packet{
-			Pkttype: &pph,
-		}
+		slog.Info("advertise", "me", me, "state", lstate, "generation", gen,
+			"routes", len(routes), "parts", len(parts),
+			"nameserver", nameservers)
 
-		out, err := proto.Marshal(&pkt)
-		if err != nil {
-			slog.Error("Failed marshaling", "error", err)
-			os.Exit(1)
+		for _, an := range parts {
+			pph := link_proto.Packet_Announce{Announce: an}
+			pkt := link_proto.Packet{
+				Pkttype: &pph,
+			}
+			pe.sendPacket(c, &pkt)
 		}
+	}
+}
+
+/*
+* Our tunnel's nameservers serve the configured routing domains, or the
+* tunnel's search domains.  Nothing to route without either.
+ */
+func advertisedDnsRoutes(nameservers string, searchdomains string) []*link_proto.DnsRoute {
+
+	domains := config.Get().Dns.Domains
+	if len(domains) == 0 {
+		domains = inet.RoutingDomains(searchdomains)
+	}
+	servers := strings.Fields(nameservers)
+	if len(domains) == 0 || len(servers) == 0 {
+		return nil
+	}
+	return []*link_proto.DnsRoute{{Domains: domains, Nameservers: servers}}
+}
+
+func ipString(ip net.IP) string {
+
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+/*
+* Largest announcement that fits the datagram limit and the link MTU.
+ */
+func announceLimit(c *ConnectionCtx) int {
+
+	limit := config.Get().MaxDatagramSize
+	if mtu := c.Intf.MTU - consts.UDP6Overhead; mtu > 0 && mtu < limit {
+		limit = mtu
+	}
+	return limit - announceOverhead
+}
 
-		_, err = c.PktConn.WriteTo(out, nil, dst)
-		if err != nil {
-			slog.Error("failed writing", "error", err)
+/*
+* Spread routes over as few copies of base as fit in limit bytes each.
+ */
+func splitAnnounce(base *link_proto.Announce, routes []*link_proto.Route,
+	limit int) []*link_proto.Announce {
+
+	parts := []*link_proto.Announce{}
+	cur := proto.Clone(base).(*link_proto.Announce)
+	size := proto.Size(cur)
+
+	for _, r := range routes {
+
+		rs := proto.Size(r) + 3 // field tag and length
+		if len(cur.Routes) > 0 && size+rs > limit {
+			parts = append(parts, cur)
+			cur = proto.Clone(base).(*link_proto.Announce)
+			size = proto.Size(cur)
 		}
+		cur.Routes = append(cur.Routes, r)
+		size += rs
+	}
+	parts = append(parts, cur)
+
+	for i, p := range parts {
+		p.Part = uint32(i)
+		p.Parts = uint32(len(parts))
 	}
+	return parts
 }
@@ -0,0 +1,156 @@
+package engine
+
+/*
+* The protocol runs over IPv6 link local multicast, or IPv4 multicast in
+* 224.0.0.0/24 on networks where IPv6 is turned off.  transport: auto uses
+* IPv6 on interfaces with an IPv6 address and IPv4 on those with an IPv4
+* one, both on dual stack interfaces, so hosts with IPv6 turned off and
+* their dual stack peers still hear each other.  Both feed the same packet
+* handlers, and a packet heard over both is dropped the second time by the
+* replay window.
+ */
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	transportIPv6 string = "ipv6"
+	transportIPv4 string = "ipv4"
+)
+
+/*
+* A multicast socket of either family.
+ */
+type packetConn interface {
+	// dst is the address the packet was sent to, nil when unknown.
+	ReadFrom(b []byte) (n int, dst net.IP, src net.Addr, err error)
+	WriteTo(b []byte, ifindex int, dst net.Addr) error
+	JoinGroup(ifi *net.Interface, group net.IP) error
+}
+
+type udp6Conn struct {
+	pc *ipv6.PacketConn
+}
+
+func (c *udp6Conn) ReadFrom(b []byte) (int, net.IP, net.Addr, error) {
+
+	n, cm, src, err := c.pc.ReadFrom(b)
+	if cm != nil {
+		return n, cm.Dst, src, err
+	}
+	return n, nil, src, err
+}
+
+func (c *udp6Conn) WriteTo(b []byte, ifindex int, dst net.Addr) error {
+
+	cm := ipv6.ControlMessage{IfIndex: ifindex}
+	_, err := c.pc.WriteTo(b, &cm, dst)
+	return err
+}
+
+func (c *udp6Conn) JoinGroup(ifi *net.Interface, group net.IP) error {
+	return c.pc.JoinGroup(ifi, &net.UDPAddr{IP: group})
+}
+
+type udp4Conn struct {
+	pc *ipv4.PacketConn
+}
+
+func (c *udp4Conn) ReadFrom(b []byte) (int, net.IP, net.Addr, error) {
+
+	n, cm, src, err := c.pc.ReadFrom(b)
+	if cm != nil {
+		return n, cm.Dst, src, err
+	}
+	return n, nil, src, err
+}
+
+func (c *udp4Conn) WriteTo(b []byte, ifindex int, dst net.Addr) error {
+
+	cm := ipv4.ControlMessage{IfIndex: ifindex}
+	_, err := c.pc.WriteTo(b, &cm, dst)
+	return err
+}
+
+func (c *udp4Conn) JoinGroup(ifi *net.Interface, group net.IP) error {
+	return c.pc.JoinGroup(ifi, &net.UDPAddr{IP: group})
+}
+
+/*
+* Open the listening socket for a transport.
+ */
+func openTransport(transport string) (packetConn, error) {
+
+	cfg := config.Get()
+
+	if transport == transportIPv6 {
+		listener, err := net.ListenPacket("udp6", cfg.ListenAddr())
+		if err != nil {
+			return nil, fmt.Errorf("listen %s: %w", cfg.ListenAddr(), err)
+		}
+		return &udp6Conn{pc: ipv6.NewPacketConn(listener)}, nil
+	}
+
+	listener, err := net.ListenPacket("udp4", cfg.ListenAddr4())
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", cfg.ListenAddr4(), err)
+	}
+	pc := ipv4.NewPacketConn(listener)
+
+	// The port also gets broadcasts and unicast, only the group counts.
+	if err := pc.SetControlMessage(ipv4.FlagDst, true); err != nil {
+		slog.Warn("can't get packet destinations", "error", err)
+	}
+	if err := pc.SetMulticastTTL(1); err != nil {
+		slog.Warn("can't set multicast ttl", "error", err)
+	}
+	return &udp4Conn{pc: pc}, nil
+}
+
+/*
+* Transports for an interface with the given addresses.
+ */
+func pickTransports(addrs []net.Addr) []string {
+
+	switch config.Get().Transport {
+	case transportIPv6:
+		return []string{transportIPv6}
+	case transportIPv4:
+		return []string{transportIPv4}
+	}
+
+	has6, has4 := false, false
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			has6 = has6 || ipn.IP.To4() == nil
+			has4 = has4 || ipn.IP.To4() != nil
+		}
+	}
+
+	transports := []string{}
+	if has6 {
+		transports = append(transports, transportIPv6)
+	}
+	if has4 || !has6 {
+		transports = append(transports, transportIPv4)
+	}
+	return transports
+}
+
+/*
+* Multicast group a transport sends to.
+ */
+func groupAddr(transport string) *net.UDPAddr {
+
+	cfg := config.Get()
+	if transport == transportIPv6 {
+		return &net.UDPAddr{IP: net.ParseIP(cfg.GroupAddr), Port: cfg.ListenPort}
+	}
+	return &net.UDPAddr{IP: net.ParseIP(cfg.GroupAddr4), Port: cfg.ListenPort}
+}
@@ -0,0 +1,81 @@
+package engine
+
+/*
+* Signed announcements.  Gateways load their identity, clients check the
+* signer against the pinned gateway keys.
+ */
+import (
+	"crypto/ed25519"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/code-ointment/link-share/internal/auth"
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/link_proto"
+)
+
+func (pe *ProtocolEngine) initSigning() {
+
+	signing := config.Get().Security.Signing
+
+	if pe.role != consts.ROLE_CLIENT {
+		id, err := auth.LoadIdentity(signing.KeyFile)
+		switch {
+		case err == nil:
+			pe.identity = id
+			slog.Info("signing announcements", "fingerprint", id.Fingerprint())
+		case errors.Is(err, os.ErrNotExist):
+			slog.Debug("no identity, announcements unsigned",
+				"key file", signing.KeyFile)
+		default:
+			slog.Error("failed loading identity", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if pe.role != consts.ROLE_GATEWAY {
+		pe.trust = auth.NewTrustStore(signing.TrustStore)
+	}
+}
+
+/*
+* May this announcement be acted on?  Unsigned announcements pass unless
+* signatures are required or the gateway has a pinned key.  A pinned gateway
+* showing up with a different key is refused loudly.
+ */
+func (pe *ProtocolEngine) trustAnnounce(an *link_proto.Announce,
+	signer []byte) bool {
+
+	if pe.trust == nil {
+		return true
+	}
+
+	signing := config.Get().Security.Signing
+	gw := an.GetGateway()
+
+	if signer == nil {
+		if signing.Require || pe.trust.IsPinned(gw) {
+			pe.signatureRejects.Add(1)
+			slog.Warn("unsigned announcement refused", "gw", gw)
+			return false
+		}
+		return true
+	}
+
+	err := pe.trust.Check(gw, ed25519.PublicKey(signer), signing.Tofu)
+	if err == nil {
+		return true
+	}
+
+	pe.signatureRejects.Add(1)
+	if errors.Is(err, auth.ErrKeyMismatch) {
+		slog.Error("!!! GATEWAY KEY CHANGED - possible impersonation, announcement refused !!!",
+			"gw", gw, "error", err)
+		return false
+	}
+	slog.Warn("announcement from untrusted gateway refused",
+		"gw", gw, "error", err)
+	return false
+}
@@ -0,0 +1,196 @@
+package events
+
+/*
+* In process event bus.  Publishing never blocks: each subscriber has a
+* queue of pending events and a wake up signal holding at most one wake up,
+* so a burst costs one append per event and no go routines.  Subscribers
+* either take whatever is pending or wait for a burst to settle and take it
+* as one batch, so a VPN adding 200 routes at connect time leads to one
+* advertisement.
+ */
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type Kind int
+
+const (
+	LinkUp Kind = iota + 1
+	LinkDown
+	RouteLearned
+	RouteWithdrawn
+	DnsChanged
+	PeerJoined
+	PeerExpired
+)
+
+func (k Kind) String() string {
+
+	switch k {
+	case LinkUp:
+		return "link-up"
+	case LinkDown:
+		return "link-down"
+	case RouteLearned:
+		return "route-learned"
+	case RouteWithdrawn:
+		return "route-withdrawn"
+	case DnsChanged:
+		return "dns-changed"
+	case PeerJoined:
+		return "peer-joined"
+	case PeerExpired:
+		return "peer-expired"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Kind   Kind
+	Name   string // link, route destination or peer id
+	Link   string // link a route is on
+	Tunnel bool   // link events, the link is a tunnel
+	Time   time.Time
+}
+
+/*
+* Events a subscriber may fall behind by before the oldest are dropped.
+ */
+const maxPending = 4096
+
+type Bus struct {
+	mutex sync.Mutex
+	subs  []*Subscription
+}
+
+type Subscription struct {
+	kinds   map[Kind]bool // nil for every kind
+	mutex   sync.Mutex
+	pending []Event
+	dropped uint64
+	wake    chan struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+/*
+* Hand an event to every subscriber interested in its kind.
+ */
+func (b *Bus) Publish(ev Event) {
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mutex.Lock()
+	subs := b.subs
+	b.mutex.Unlock()
+
+	for _, s := range subs {
+		if s.kinds == nil || s.kinds[ev.Kind] {
+			s.deliver(ev)
+		}
+	}
+}
+
+/*
+* Subscribe to the given kinds of event, all of them when none are named.
+ */
+func (b *Bus) Subscribe(kinds ...Kind) *Subscription {
+
+	s := Subscription{
+		wake: make(chan struct{}, 1),
+	}
+	if len(kinds) > 0 {
+		s.kinds = map[Kind]bool{}
+		for _, k := range kinds {
+			s.kinds[k] = true
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Publish walks the list without the lock, never modify it in place.
+	subs := make([]*Subscription, 0, len(b.subs)+1)
+	subs = append(subs, b.subs...)
+	b.subs = append(subs, &s)
+	return &s
+}
+
+func (s *Subscription) deliver(ev Event) {
+
+	s.mutex.Lock()
+	if len(s.pending) >= maxPending {
+		s.pending = s.pending[1:]
+		s.dropped++
+		if s.dropped == 1 {
+			slog.Warn("event subscriber behind, dropping oldest events")
+		}
+	}
+	s.pending = append(s.pending, ev)
+	s.mutex.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+* Take the pending events.
+ */
+func (s *Subscription) take() []Event {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	evs := s.pending
+	s.pending = nil
+	return evs
+}
+
+/*
+* Block until there are events and return them.
+ */
+func (s *Subscription) Wait() []Event {
+
+	for {
+		<-s.wake
+		if evs := s.take(); len(evs) > 0 {
+			return evs
+		}
+	}
+}
+
+/*
+* Block until there are events, then keep gathering them until none arrive
+* for quiet or limit passes, and return the lot.
+ */
+func (s *Subscription) WaitSettled(quiet time.Duration, limit time.Duration) []Event {
+
+	evs := s.Wait()
+
+	deadline := time.After(limit)
+	t := time.NewTimer(quiet)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.wake:
+			evs = append(evs, s.take()...)
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(quiet)
+		case <-t.C:
+			return append(evs, s.take()...)
+		case <-deadline:
+			return append(evs, s.take()...)
+		}
+	}
+}
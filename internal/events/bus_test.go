@@ -0,0 +1,94 @@
+package events
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWaitSettledCoalesces(t *testing.T) {
+
+	b := NewBus()
+	s := b.Subscribe(RouteLearned)
+
+	go func() {
+		for i := 0; i < 200; i++ {
+			b.Publish(Event{Kind: RouteLearned, Name: strconv.Itoa(i)})
+			if i%20 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	evs := s.WaitSettled(100*time.Millisecond, 5*time.Second)
+	if len(evs) != 200 {
+		t.Fatalf("batch of %d events, want 200", len(evs))
+	}
+	for i, ev := range evs {
+		if ev.Name != strconv.Itoa(i) {
+			t.Fatalf("event %d is %s, out of order", i, ev.Name)
+		}
+	}
+	if left := s.take(); len(left) != 0 {
+		t.Fatalf("%d events left after the batch", len(left))
+	}
+}
+
+func TestWaitSettledLimit(t *testing.T) {
+
+	b := NewBus()
+	s := b.Subscribe()
+
+	// Never quiet for long enough, only the limit ends the wait.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b.Publish(Event{Kind: LinkUp})
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	evs := s.WaitSettled(50*time.Millisecond, 200*time.Millisecond)
+	took := time.Since(start)
+
+	if len(evs) == 0 {
+		t.Fatal("no events")
+	}
+	if took < 200*time.Millisecond || took > time.Second {
+		t.Fatalf("returned after %s, limit 200ms", took)
+	}
+}
+
+func TestFullQueueDropsOldest(t *testing.T) {
+
+	b := NewBus()
+	s := b.Subscribe(PeerJoined)
+
+	const extra = 10
+	for i := 0; i < maxPending+extra; i++ {
+		b.Publish(Event{Kind: PeerJoined, Name: strconv.Itoa(i)})
+	}
+	// Not subscribed to, never queued.
+	b.Publish(Event{Kind: PeerExpired})
+
+	evs := s.Wait()
+	if len(evs) != maxPending {
+		t.Fatalf("%d events pending, want %d", len(evs), maxPending)
+	}
+	if evs[0].Name != strconv.Itoa(extra) {
+		t.Fatalf("oldest kept is %s, want %d", evs[0].Name, extra)
+	}
+	if last := evs[len(evs)-1].Name; last != strconv.Itoa(maxPending+extra-1) {
+		t.Fatalf("newest is %s", last)
+	}
+	if s.dropped != extra {
+		t.Fatalf("%d dropped, want %d", s.dropped, extra)
+	}
+}
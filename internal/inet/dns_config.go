@@ -1,5 +1,9 @@
 package inet
 
+import (
+	"strings"
+)
+
 /*
 * Define an interface used to control DNS config.
 * Configure new config BackupConfig(), Set*,Commit()
@@ -21,4 +25,70 @@ type DnsConfig interface {
 	RestoreConfig()
 	// Commit changes
 	Commit() bool
+	// Name of the mechanism, for status reporting
+	Backend() string
+	// BackupConfig has run and RestoreConfig not since, meaning our
+	// settings are applied.  Kept in memory so dry runs report it too.
+	IsBackedUp() bool
+
+	// Split DNS.  When set, Commit resolves only the routing domains
+	// through their nameservers, as far as the mechanism allows, and the
+	// Set* values above are replaced.
+	SetDnsRoutes(intf string, routes []DnsRoute)
+	GetDnsRoutes(intf string) []DnsRoute
+}
+
+/*
+* Names under Domains are resolved by Nameservers.
+ */
+type DnsRoute struct {
+	Domains     []string
+	Nameservers []string
+}
+
+/*
+* Domains in a space separated list, less resolved's routing markers.  The
+* catch all "~." is dropped.
+ */
+func RoutingDomains(domains string) []string {
+
+	r := []string{}
+	for _, d := range strings.Fields(domains) {
+		d = strings.TrimPrefix(d, "~")
+		if d == "." || d == "" {
+			continue
+		}
+		r = append(r, d)
+	}
+	return r
+}
+
+/*
+* The nameservers and domains routes need, the domains marked with prefix.
+ */
+func flattenRoutes(routes []DnsRoute, prefix string) ([]string, []string) {
+
+	servers := []string{}
+	domains := []string{}
+	for _, r := range routes {
+		servers = appendUnique(servers, r.Nameservers...)
+		for _, d := range r.Domains {
+			domains = appendUnique(domains, prefix+d)
+		}
+	}
+	return servers, domains
+}
+
+func appendUnique(list []string, values ...string) []string {
+
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			found = found || l == v
+		}
+		if !found && v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
 }
@@ -6,10 +6,11 @@ package inet
 import (
 	"log/slog"
 	"net"
-	"strings"
 	"sync"
 
+	"github.com/code-ointment/link-share/internal/config"
 	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/events"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
@@ -18,11 +19,14 @@ type InterfaceManager struct {
 	mutex      sync.Mutex
 	interfaces []netlink.Link
 	tunnels    []netlink.Link
+	bus        *events.Bus
 }
 
-func NewInterfaceManager() *InterfaceManager {
+func NewInterfaceManager(bus *events.Bus) *InterfaceManager {
 
-	ifm := InterfaceManager{}
+	ifm := InterfaceManager{
+		bus: bus,
+	}
 	var err error
 	var interfaces []netlink.Link
 
@@ -56,13 +60,10 @@ func (ifm *InterfaceManager) GetInterfaces() []netlink.Link {
  */
 func (ifm *InterfaceManager) classify(l netlink.Link) consts.LinkClass {
 
-	notThese := []string{"vmnet", "docker", "vibr"}
 	lattrs := l.Attrs()
 
-	for _, n := range notThese {
-		if strings.HasPrefix(lattrs.Name, n) {
-			return consts.UNUSED
-		}
+	if config.Get().ExcludedInterface(lattrs.Name) || lattrs.Name == dnsLinkName {
+		return consts.UNUSED
 	}
 
 	ifm.mutex.Lock()
@@ -108,6 +109,19 @@ func (ifm *InterfaceManager) GetLinkByIndex(index int) netlink.Link {
 	return nil
 }
 
+/*
+* Current MTU of the named link, 0 when it can't be found.
+ */
+func (ifm *InterfaceManager) LinkMTU(name string) int {
+
+	lnk, err := netlink.LinkByName(name)
+	if err != nil {
+		slog.Debug("link lookup failed", "name", name, "error", err)
+		return 0
+	}
+	return lnk.Attrs().MTU
+}
+
 /*
 * Test for upper and lower halfs being up.
  */
@@ -139,19 +153,71 @@ func (ifm *InterfaceManager) linkMonitor() {
 		update := <-ch
 		attrs := update.Link.Attrs()
 
+		if update.Header.Type == unix.RTM_DELLINK {
+			if ifm.forget(attrs.Index) {
+				slog.Info("link removed", "name", attrs.Name)
+				ifm.notify(update.Link, false)
+			}
+			continue
+		}
+
 		l := ifm.GetLinkByIndex(attrs.Index)
 		if l == nil {
-			ifm.classify(update.Link)
+			if ifm.classify(update.Link) != consts.UNUSED {
+				ifm.notify(update.Link, ifm.IsUp(update.Link))
+			}
 		} else {
 			st1 := ifm.IsUp(l)
 			st2 := ifm.IsUp(update.Link)
-			if st1 != st2 {
-				slog.Info("state change", "new state", st2)
-			}
 			// TODO: revisit what's saved.
 			l.Attrs().RawFlags = update.Link.Attrs().RawFlags
+			if st1 != st2 {
+				slog.Info("state change", "name", attrs.Name, "new state", st2)
+				ifm.notify(l, st2)
+			}
+		}
+	}
+}
+
+/*
+* Publish a link coming up, going down or disappearing.
+ */
+func (ifm *InterfaceManager) notify(l netlink.Link, up bool) {
+
+	kind := events.LinkDown
+	if up {
+		kind = events.LinkUp
+	}
+	ifm.bus.Publish(events.Event{
+		Kind:   kind,
+		Name:   l.Attrs().Name,
+		Tunnel: l.Attrs().RawFlags&unix.IFF_POINTOPOINT == unix.IFF_POINTOPOINT,
+	})
+}
+
+/*
+* Drop a deleted link from our lists.
+ */
+func (ifm *InterfaceManager) forget(index int) bool {
+
+	ifm.mutex.Lock()
+	defer ifm.mutex.Unlock()
+
+	found := false
+	keep := func(links []netlink.Link) []netlink.Link {
+		out := []netlink.Link{}
+		for _, l := range links {
+			if l.Attrs().Index == index {
+				found = true
+				continue
+			}
+			out = append(out, l)
 		}
+		return out
 	}
+	ifm.interfaces = keep(ifm.interfaces)
+	ifm.tunnels = keep(ifm.tunnels)
+	return found
 }
 
 func (ifm *InterfaceManager) GetTunnelByIndex(linkIndex int) netlink.Link {
@@ -177,6 +243,19 @@ func (ifm *InterfaceManager) HasTunnels() bool {
 	return v
 }
 
+/*
+* Is at least one tunnel up?
+ */
+func (ifm *InterfaceManager) TunnelsUp() bool {
+
+	for _, tun := range ifm.GetTunnels() {
+		if ifm.IsUp(tun) {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 * Return a copy of our current tunnel set
  */
@@ -14,14 +14,21 @@ package inet
 * nft add chain inet nat postrouting '{ type nat hook postrouting priority 100; }'
 * nft add rule inet nat postrouting oifname "ens33" masquerade
 * nft add rule inet nat postrouting iifname "ens33" masquerade
+*
+* nft add rule inet filter forward oifname "ens33" tcp flags syn \
+*     tcp option maxseg size set rt mtu
+* nft add rule inet filter forward iifname "ens33" tcp flags syn \
+*     tcp option maxseg size set rt mtu
  */
 
 import (
 	"log/slog"
 	"os"
 
+	"github.com/code-ointment/link-share/internal/config"
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
 )
 
 type NftUtil struct {
@@ -44,6 +51,24 @@ func NewNftUtil(linkName string) *NftUtil {
 	return &nfu
 }
 
+func (nfu *NftUtil) LinkName() string {
+	return nfu.linkName
+}
+
+/*
+* Names of the tables we have installed.
+ */
+func (nfu *NftUtil) Tables() []string {
+
+	t := []string{}
+	for _, tbl := range []*nftables.Table{nfu.nat, nfu.filter} {
+		if tbl != nil {
+			t = append(t, "inet "+tbl.Name)
+		}
+	}
+	return t
+}
+
 /*
 * Force fit for C IFNAMSIZ
  */
@@ -58,6 +83,11 @@ func (nfu *NftUtil) ifname(n string) []byte {
  */
 func (nfu *NftUtil) EnableForwarding() {
 
+	if dryRun("nftables add masquerade and filter tables", "link", nfu.linkName,
+		"clamp mss", config.Get().Mtu.ClampMss) {
+		return
+	}
+
 	c, err := nftables.New(nftables.AsLasting())
 	if err != nil {
 		slog.Error("failed opening nftables", "error", err)
@@ -153,6 +183,11 @@ func (nfu *NftUtil) EnableForwarding() {
 		Type:     nftables.ChainTypeFilter,
 	})
 
+	if config.Get().Mtu.ClampMss {
+		nfu.clampMss(c, expr.MetaKeyOIFNAME)
+		nfu.clampMss(c, expr.MetaKeyIIFNAME)
+	}
+
 	err = c.Flush()
 	if err != nil {
 		slog.Error("failed flushing")
@@ -163,11 +198,74 @@ func (nfu *NftUtil) EnableForwarding() {
 	}
 }
 
+/*
+* Fit the MSS of TCP connections forwarded over the link to the MTU of the
+* route, for hosts that don't set it on their routes.  Called once for SYNs
+* leaving by the link and once for the SYN-ACKs coming back on it, so both
+* ends learn the smaller segment size.
+ */
+func (nfu *NftUtil) clampMss(c *nftables.Conn, key expr.MetaKey) {
+
+	c.AddRule(&nftables.Rule{
+		Table: nfu.filter,
+		Chain: nfu.filterForward,
+		Exprs: []expr.Any{
+			// meta load oifname or iifname => reg 1
+			&expr.Meta{Key: key, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     nfu.ifname(nfu.linkName),
+			},
+			// meta load l4proto => reg 1, tcp only
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{unix.IPPROTO_TCP},
+			},
+			// tcp flags & syn != 0
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       13,
+				Len:          1,
+			},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            1,
+				Mask:           []byte{0x02},
+				Xor:            []byte{0x00},
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpNeq,
+				Register: 1,
+				Data:     []byte{0x00},
+			},
+			// rt mtu => reg 1, the MSS for the route's MTU
+			&expr.Rt{Register: 1, Key: expr.RtTCPMSS},
+			// tcp option maxseg size set reg 1
+			&expr.Exthdr{
+				SourceRegister: 1,
+				Type:           2,
+				Offset:         2,
+				Len:            2,
+				Op:             expr.ExthdrOpTcpopt,
+			},
+		},
+	})
+}
+
 /*
 * Remove tables and null out object.
  */
 func (nfu *NftUtil) DisableForwarding() {
 
+	if dryRun("nftables delete masquerade and filter tables", "link", nfu.linkName) {
+		return
+	}
+
 	c, err := nftables.New(nftables.AsLasting())
 	if err != nil {
 		slog.Error("failed opening nftables", "error", err)
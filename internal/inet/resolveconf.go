@@ -21,6 +21,9 @@ const (
 type ResolveConf struct {
 	NameServers string
 	Domains     string
+
+	routes   []DnsRoute
+	backedUp bool // BackupConfig ran, RestoreConfig not since
 }
 
 func NewResolveConf() *ResolveConf {
@@ -98,14 +101,79 @@ func (rc *ResolveConf) GetDomains(intf string) string {
 	return rc.Domains
 }
 
+/*
+* Nameservers and search domains in a resolv.conf file.
+ */
+func readResolvConf(path string) ([]string, []string) {
+
+	servers := []string{}
+	domains := []string{}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return servers, domains
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			servers = append(servers, fields[1])
+		case "search", "domain":
+			domains = append(domains, fields[1:]...)
+		}
+	}
+	return servers, domains
+}
+
+/*
+* resolv.conf can't send a domain to particular servers.  The gateway's
+* nameservers are tried first, for every name, with the original ones
+* behind them, and the routing domains become search domains.
+ */
+func (rc *ResolveConf) applyRoutes() {
+
+	servers, domains := flattenRoutes(rc.routes, "")
+
+	orig := resolv_conf
+	if _, err := os.Stat(backupFile); err == nil {
+		orig = backupFile
+	}
+	origServers, origDomains := readResolvConf(orig)
+	servers = appendUnique(servers, origServers...)
+	domains = appendUnique(domains, origDomains...)
+
+	if len(servers) > 3 {
+		slog.Info("resolv.conf holds 3 nameservers, dropping the rest",
+			"dropped", servers[3:])
+		servers = servers[:3]
+	}
+	rc.NameServers = strings.Join(servers, " ")
+	rc.Domains = strings.Join(domains, " ")
+}
+
 func (rc *ResolveConf) Commit() bool {
 
+	if len(rc.routes) > 0 {
+		rc.applyRoutes()
+	}
+
 	fields := strings.Split(rc.NameServers, " ")
 	if len(fields) > 3 {
 		slog.Error("invalid number of nameservers, 3 or less required")
 		return false
 	}
 
+	if dryRun("rewrite "+resolv_conf, "nameservers", rc.NameServers,
+		"search", rc.Domains) {
+		return true
+	}
+
 	fd, err := os.OpenFile(resolv_conf, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
 	if err != nil {
 		slog.Warn("failed opening "+resolv_conf, "error", err)
@@ -119,14 +187,21 @@ func (rc *ResolveConf) Commit() bool {
 		fmt.Fprintf(fd, "nameserver %s\n", f)
 	}
 
-	return false
+	return true
 }
 
 func (rc *ResolveConf) BackupConfig() bool {
 
+	if dryRun("back up "+resolv_conf, "to", backupFile) {
+		rc.backedUp = true
+		return true
+	}
+
+	// Left by an earlier run, it still holds the original settings.
 	if _, err := os.Stat(backupFile); err == nil {
-		slog.Warn("dns config already backed up")
-		return false
+		slog.Info("keeping earlier dns backup", "file", backupFile)
+		rc.backedUp = true
+		return true
 	}
 
 	src, err := os.Open(resolv_conf)
@@ -144,6 +219,7 @@ func (rc *ResolveConf) BackupConfig() bool {
 	defer dest.Close()
 
 	io.Copy(dest, src)
+	rc.backedUp = true
 	return true
 }
 
@@ -152,8 +228,14 @@ func (rc *ResolveConf) BackupConfig() bool {
  */
 func (rc *ResolveConf) RestoreConfig() {
 
+	if dryRun("restore "+resolv_conf, "from", backupFile) {
+		rc.backedUp = false
+		return
+	}
+
 	if _, err := os.Lstat(backupFile); err != nil {
 		slog.Debug("no backup dns config")
+		rc.backedUp = false
 		return
 	}
 
@@ -173,4 +255,21 @@ func (rc *ResolveConf) RestoreConfig() {
 
 	io.Copy(dest, src)
 	os.Remove(backupFile)
+	rc.backedUp = false
+}
+
+func (rc *ResolveConf) SetDnsRoutes(intf string, routes []DnsRoute) {
+	rc.routes = routes
+}
+
+func (rc *ResolveConf) GetDnsRoutes(intf string) []DnsRoute {
+	return rc.routes
+}
+
+func (rc *ResolveConf) Backend() string {
+	return "resolv.conf"
+}
+
+func (rc *ResolveConf) IsBackedUp() bool {
+	return rc.backedUp
 }
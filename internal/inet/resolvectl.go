@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"encoding/json"
 	"log/slog"
+	"net"
 	"os"
 	"strings"
 
 	"github.com/code-ointment/link-share/internal/linux"
+	"github.com/vishvananda/netlink"
 )
 
 type Resolvectl struct {
@@ -15,6 +17,10 @@ type Resolvectl struct {
 	ResolvConfMode  string
 
 	Links []*ResolvectlEntry
+	Link  string // LAN link the settings are for, kept with the backup
+
+	routes   []DnsRoute
+	backedUp bool // BackupConfig ran, RestoreConfig not since
 }
 
 func NewResolvectl() *Resolvectl {
@@ -27,6 +33,10 @@ func NewResolvectl() *Resolvectl {
 }
 
 const (
+	// Link holding the gateway's routing domains and nameservers.
+	dnsLinkName string = "lsdns0"
+	dnsLinkAddr string = "169.254.53.53/32"
+
 	backupDir      string = "/var/tmp/link-share"
 	backupJsonFile string = "/var/tmp/link-share/backup.json"
 )
@@ -116,6 +126,8 @@ func (rc *Resolvectl) addResolvectlEntry(intf string) *ResolvectlEntry {
 // Space separated of servers.  Limit is 3.  See man resolv.conf
 func (rc *Resolvectl) SetNameServers(intf string, servers string) {
 
+	rc.Link = intf
+
 	entry := rc.findEntryByIntf(intf)
 	if entry == nil {
 		entry = rc.addResolvectlEntry(intf)
@@ -138,6 +150,8 @@ func (rc *Resolvectl) GetNameServers(intf string) string {
 
 // Space separated list of search domains
 func (rc *Resolvectl) SetDomains(intf string, domains string) {
+
+	rc.Link = intf
 	entry := rc.findEntryByIntf(intf)
 	if entry == nil {
 		entry = rc.addResolvectlEntry(intf)
@@ -158,15 +172,27 @@ func (rc *Resolvectl) GetDomains(intf string) string {
 // Backup the current configuration
 func (rc *Resolvectl) BackupConfig() bool {
 
+	if dryRun("back up resolvectl settings", "to", backupJsonFile) {
+		rc.backedUp = true
+		return true
+	}
+
+	// Left by an earlier run, it still holds the original settings.
 	if _, err := os.Stat(backupJsonFile); err == nil {
-		slog.Warn("dns config already backed up")
-		return false
+		slog.Info("keeping earlier dns backup", "file", backupJsonFile)
+		rc.backedUp = true
+		return true
 	}
 	if len(rc.Links) == 0 {
 		slog.Warn("resolvectl ReadConfig not invoked, nothing to back up")
 		return false
 	}
 
+	// Settings go on the default link until a Set* call names one.
+	if rc.Link == "" {
+		rc.Link = defaultLinkName()
+	}
+
 	rc.initTmp()
 	fd, err := os.OpenFile(backupJsonFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
 	if err != nil {
@@ -181,20 +207,28 @@ func (rc *Resolvectl) BackupConfig() bool {
 		return false
 	}
 	fd.Write(b)
+	rc.backedUp = true
 	return true
 }
 
 // Restore previously backed up configuration
 func (rc *Resolvectl) RestoreConfig() {
 
+	if dryRun("restore resolvectl settings", "from", backupJsonFile) {
+		rc.backedUp = false
+		return
+	}
+
 	if _, err := os.Stat(backupJsonFile); err != nil {
 		slog.Debug("no backup available")
+		rc.backedUp = false
 		return
 	}
 
 	b, err := os.ReadFile(backupJsonFile)
 	if err != nil {
 		slog.Warn("error reading backup", "error", err)
+		return
 	}
 
 	err = json.Unmarshal(b, rc)
@@ -202,38 +236,221 @@ func (rc *Resolvectl) RestoreConfig() {
 		slog.Warn("error marshalling", "error", err)
 		return
 	}
-	rc.Commit()
+	// Backups from older releases don't name the link.
+	if rc.Link == "" {
+		rc.Link = defaultLinkName()
+	}
+	// Back to the LAN link alone.  The backup stays for the next try
+	// should that fail.
+	rc.routes = nil
+	if !rc.Commit() {
+		slog.Warn("dns restore failed, keeping backup", "file", backupJsonFile)
+		return
+	}
 	os.Remove(backupJsonFile)
+	rc.backedUp = false
 }
 
-// Commit changes
-func (rc *Resolvectl) Commit() bool {
+/*
+* Link the default route leaves by.
+ */
+func defaultLinkName() string {
 
-	ifm := NewInterfaceManager()
-	l := ifm.GetDefaultLink()
+	routes, err := netlink.RouteGet(net.ParseIP("8.8.8.8"))
+	if err != nil || len(routes) == 0 {
+		slog.Warn("get default link failed", "error", err)
+		return ""
+	}
+	l, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		slog.Warn("get default link failed", "error", err)
+		return ""
+	}
+	return l.Attrs().Name
+}
 
-	vstr := rc.GetDomains(l.Attrs().Name)
-	domains := strings.Split(vstr, " ")
-	vec := []string{"resolvectl", "domain", l.Attrs().Name}
-	vec = append(vec, domains...)
+/*
+* The link's settings before we changed them.
+ */
+func (rc *Resolvectl) original(intf string) (string, string) {
 
-	result := linux.Run(vec)
-	if result.Err != nil || result.ExitCode != 0 {
-		slog.Warn("set domain failed",
-			"error", result.Err, "exit code", result.ExitCode)
+	orig := Resolvectl{}
+	if b, err := os.ReadFile(backupJsonFile); err == nil {
+		if err := json.Unmarshal(b, &orig); err != nil {
+			slog.Warn("error parsing backup", "error", err)
+		}
+	} else {
+		orig.Links = rc.Links
+	}
+
+	if entry := orig.findEntryByIntf(intf); entry != nil {
+		return entry.DnsServers, entry.DnsDomains
+	}
+	return "", ""
+}
+
+/*
+* resolved sends names no routing domain claims to the current server of a
+* DefaultRoute link, the first in its list, so the gateway's nameservers
+* can't join the LAN link's.  They go on a dummy link of our own with
+* DefaultRoute off, holding only the ~domain routing domains, and the LAN
+* link keeps its settings.  resolved sends a link's queries out of that
+* link, so each server names the LAN link, address%ifname, instead.
+ */
+func (rc *Resolvectl) applyRoutes(lan string) bool {
+
+	servers, domains := flattenRoutes(rc.routes, "~")
+	for i, s := range servers {
+		servers[i] = s + "%" + lan
+	}
+
+	if !rc.restoreLink(lan) || !addDnsLink() {
+		return false
+	}
+	if !rc.setLink(dnsLinkName, strings.Join(servers, " "),
+		strings.Join(domains, " ")) {
 		return false
 	}
+	return runResolvectl("default-route", dnsLinkName, "false")
+}
+
+/*
+* Put the LAN link back to its own settings, should the gateway's have been
+* applied to it whole before.
+ */
+func (rc *Resolvectl) restoreLink(lan string) bool {
 
-	vstr = rc.GetNameServers(l.Attrs().Name)
-	nameservers := strings.Split(vstr, " ")
-	vec = []string{"resolvectl", "dns", l.Attrs().Name}
-	vec = append(vec, nameservers...)
+	servers, domains := rc.original(lan)
+	rc.ReadConfig()
+	if sameFields(rc.GetNameServers(lan), servers) &&
+		sameFields(rc.GetDomains(lan), domains) {
+		return true
+	}
+	slog.Info("restoring lan link dns", "link", lan)
+	return rc.setLink(lan, servers, domains)
+}
 
-	result = linux.Run(vec)
+func sameFields(a string, b string) bool {
+	return strings.Join(strings.Fields(a), " ") ==
+		strings.Join(strings.Fields(b), " ")
+}
+
+/*
+* Create the dummy link, up and with an address of global scope, which
+* resolved wants before it uses a link's servers.
+ */
+func addDnsLink() bool {
+
+	if _, err := netlink.LinkByName(dnsLinkName); err == nil {
+		return true
+	}
+	if dryRun("add dns link", "link", dnsLinkName, "addr", dnsLinkAddr) {
+		return true
+	}
+
+	l := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: dnsLinkName}}
+	if err := netlink.LinkAdd(l); err != nil {
+		slog.Warn("add dns link failed", "link", dnsLinkName, "error", err)
+		return false
+	}
+	addr, err := netlink.ParseAddr(dnsLinkAddr)
+	if err == nil {
+		err = netlink.AddrAdd(l, addr)
+	}
+	if err == nil {
+		err = netlink.LinkSetUp(l)
+	}
+	if err != nil {
+		slog.Warn("dns link setup failed", "link", dnsLinkName, "error", err)
+		removeDnsLink()
+		return false
+	}
+	slog.Info("dns link added", "link", dnsLinkName)
+	return true
+}
+
+/*
+* Deleting the link takes its resolved settings with it.
+ */
+func removeDnsLink() {
+
+	l, err := netlink.LinkByName(dnsLinkName)
+	if err != nil {
+		return
+	}
+	if dryRun("remove dns link", "link", dnsLinkName) {
+		return
+	}
+	if err := netlink.LinkDel(l); err != nil {
+		slog.Warn("remove dns link failed", "link", dnsLinkName, "error", err)
+		return
+	}
+	slog.Info("dns link removed", "link", dnsLinkName)
+}
+
+/*
+* Set a link's domains and nameservers.
+ */
+func (rc *Resolvectl) setLink(intf string, servers string, domains string) bool {
+
+	if dryRun("resolvectl set link dns", "link", intf, "dns", servers,
+		"domain", domains) {
+		return true
+	}
+
+	vec := append([]string{"domain", intf}, strings.Split(domains, " ")...)
+	if !runResolvectl(vec...) {
+		return false
+	}
+	vec = append([]string{"dns", intf}, strings.Split(servers, " ")...)
+	return runResolvectl(vec...)
+}
+
+func runResolvectl(args ...string) bool {
+
+	if dryRun("resolvectl", "args", args) {
+		return true
+	}
+
+	result := linux.Run(append([]string{"resolvectl"}, args...))
 	if result.Err != nil || result.ExitCode != 0 {
-		slog.Warn("set nameserver failed",
+		slog.Warn("resolvectl failed", "args", args,
 			"error", result.Err, "exit code", result.ExitCode)
 		return false
 	}
 	return true
 }
+
+// Commit changes to the link last named by the Set* calls.
+func (rc *Resolvectl) Commit() bool {
+
+	if rc.Link == "" {
+		slog.Warn("no link for dns settings")
+		return false
+	}
+
+	if len(rc.routes) > 0 {
+		return rc.applyRoutes(rc.Link)
+	}
+
+	removeDnsLink()
+	return rc.setLink(rc.Link, rc.GetNameServers(rc.Link),
+		rc.GetDomains(rc.Link))
+}
+
+func (rc *Resolvectl) SetDnsRoutes(intf string, routes []DnsRoute) {
+	rc.Link = intf
+	rc.routes = routes
+}
+
+func (rc *Resolvectl) GetDnsRoutes(intf string) []DnsRoute {
+	return rc.routes
+}
+
+func (rc *Resolvectl) Backend() string {
+	return "resolvectl"
+}
+
+func (rc *Resolvectl) IsBackedUp() bool {
+	return rc.backedUp
+}
@@ -0,0 +1,398 @@
+package inet
+
+/*
+* Several gateway hosts may offer the same destination.  Each offer is a
+* claim, and one claim per destination is installed in the kernel, picked by
+* the chooser, or several as a multipath route when the spreader says so.
+* When the chooser prefers another claimant, or the installed owner
+* withdraws, the route is switched with a route replace; it is only deleted
+* when nobody offers it any more.  A claim may be leased, it lapses unless
+* the owner renews it in time.
+ */
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+* An owner's offer of a destination.  A zero Expires never lapses.
+ */
+type Claim struct {
+	Gateway string
+	Expires time.Time
+	MTU     int // of the owner's tunnel, 0 when unknown
+}
+
+/*
+* Pick the owner whose claim on dest should be installed.  current is the
+* installed owner, empty when there is none.  Must not call back into the
+* route manager.
+ */
+type Chooser func(dest string, owners []string, current string) string
+
+/*
+* Optionally spread dest over several of its owners, returning the weight
+* of each to use.  Fewer than two leaves the choice to the Chooser.  Must
+* not call back into the route manager.
+ */
+type Spreader func(dest string, owners []string) map[string]int
+
+/*
+* Make the owner's claims match want, keyed by destination CIDR, renewing
+* their leases, then install, switch or delete routes as the claims
+* dictate.  An empty want drops all of the owner's claims.  Returns the
+* number of routes added or switched and the number deleted.
+ */
+func (rm *RouteManager) SyncRoutes(owner string,
+	want map[string]Claim) (int, int) {
+
+	rm.syncMutex.Lock()
+	defer rm.syncMutex.Unlock()
+
+	touched := map[string]bool{}
+
+	rm.mutex.Lock()
+	for dest, owners := range rm.claims {
+		if _, ok := owners[owner]; !ok {
+			continue
+		}
+		if _, still := want[dest]; still {
+			continue
+		}
+		delete(owners, owner)
+		if len(owners) == 0 {
+			delete(rm.claims, dest)
+		}
+		touched[dest] = true
+	}
+
+	for dest, claim := range want {
+		owners := rm.claims[dest]
+		if owners == nil {
+			owners = map[string]Claim{}
+			rm.claims[dest] = owners
+		}
+		if owners[owner].Gateway != claim.Gateway ||
+			owners[owner].MTU != claim.MTU {
+			touched[dest] = true
+		}
+		owners[owner] = claim
+	}
+
+	// Retry destinations that failed to install last time.
+	for dest := range want {
+		if rm.findSelfDest(dest) == nil {
+			touched[dest] = true
+		}
+	}
+	rm.mutex.Unlock()
+
+	added := 0
+	deleted := 0
+	for dest := range touched {
+		a, d := rm.settle(dest)
+		added += a
+		deleted += d
+	}
+	return added, deleted
+}
+
+/*
+* Bring the kernel route for dest in line with its claims.
+ */
+func (rm *RouteManager) settle(dest string) (int, int) {
+
+	rm.mutex.Lock()
+	owners := map[string]Claim{}
+	for o, claim := range rm.claims[dest] {
+		owners[o] = claim
+	}
+	var cur *SelfRoute
+	if sr := rm.findSelfDest(dest); sr != nil {
+		c := *sr
+		cur = &c
+	}
+	rm.mutex.Unlock()
+
+	names := []string{}
+	for o := range owners {
+		names = append(names, o)
+	}
+	sort.Strings(names)
+
+	current := ""
+	if cur != nil {
+		current = cur.Owner
+	}
+
+	want := []Hop{}
+	if len(names) > 0 {
+		want = rm.selectHops(dest, names, owners, current)
+	}
+
+	if cur != nil && sameHops(cur.Hops, want) {
+		return 0, 0
+	}
+
+	switch {
+	case cur == nil && len(want) == 0:
+		return 0, 0
+
+	case cur == nil:
+		if rm.installRoute(dest, want, false) {
+			return 1, 0
+		}
+
+	case len(want) == 0:
+		if rm.DeleteRoute(dest, hopsString(cur.Hops)) {
+			return 0, 1
+		}
+
+	default:
+		if len(want) > 1 || len(cur.Hops) > 1 {
+			slog.Info("route next hops changed", "dst", dest,
+				"from", hopsString(cur.Hops), "to", hopsString(want))
+		} else if want[0].Owner != cur.Owner {
+			slog.Info("route failover", "dst", dest, "from", cur.Owner,
+				"to", want[0].Owner, "gw", want[0].Gateway)
+		}
+		if rm.installRoute(dest, want, true) {
+			return 1, 0
+		}
+	}
+	return 0, 0
+}
+
+/*
+* Next hops dest should have: every gateway the spreader names when it
+* names more than one, otherwise the chooser's pick.
+ */
+func (rm *RouteManager) selectHops(dest string, names []string,
+	owners map[string]Claim, current string) []Hop {
+
+	rm.mutex.Lock()
+	chooser := rm.chooser
+	spreader := rm.spreader
+	rm.mutex.Unlock()
+
+	if spreader != nil {
+		weights := spreader(dest, names)
+		if len(weights) > 1 {
+			hops := []Hop{}
+			for _, o := range names {
+				if w, ok := weights[o]; ok {
+					hops = append(hops, Hop{Owner: o,
+						Gateway: owners[o].Gateway, Weight: w,
+						MTU: owners[o].MTU})
+				}
+			}
+			return hops
+		}
+	}
+
+	next := chooser(dest, names, current)
+	if _, ok := owners[next]; !ok {
+		next = names[0]
+	}
+	return []Hop{{Owner: next, Gateway: owners[next].Gateway,
+		MTU: owners[next].MTU}}
+}
+
+func sameHops(a []Hop, b []Hop) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Owner != b[i].Owner || a[i].MTU != b[i].MTU ||
+			!net.ParseIP(a[i].Gateway).Equal(net.ParseIP(b[i].Gateway)) {
+			return false
+		}
+		if len(a) > 1 && a[i].Weight != b[i].Weight {
+			return false
+		}
+	}
+	return true
+}
+
+func hopsString(hops []Hop) string {
+
+	s := []string{}
+	for _, h := range hops {
+		if len(hops) > 1 {
+			s = append(s, fmt.Sprintf("%s weight %d", h.Gateway, h.Weight))
+		} else {
+			s = append(s, h.Gateway)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+/*
+* Default chooser.  The current owner keeps the route while it still claims
+* it, otherwise the lowest owner name wins so every client makes the same
+* choice.  owners is sorted.
+ */
+func stickyChooser(dest string, owners []string, current string) string {
+
+	for _, o := range owners {
+		if o == current {
+			return current
+		}
+	}
+	return owners[0]
+}
+
+/*
+* Replace the policy deciding between claims.
+ */
+func (rm *RouteManager) SetChooser(c Chooser) {
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.chooser = c
+}
+
+/*
+* Set, or with nil clear, the multipath policy.
+ */
+func (rm *RouteManager) SetSpreader(s Spreader) {
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.spreader = s
+}
+
+/*
+* Settle every claimed destination again, for when the chooser's view of
+* the gateways changed.
+ */
+func (rm *RouteManager) Resettle() (int, int) {
+
+	rm.syncMutex.Lock()
+	defer rm.syncMutex.Unlock()
+
+	rm.mutex.Lock()
+	dests := []string{}
+	for dest := range rm.claims {
+		dests = append(dests, dest)
+	}
+	rm.mutex.Unlock()
+
+	added := 0
+	deleted := 0
+	for _, dest := range dests {
+		a, d := rm.settle(dest)
+		added += a
+		deleted += d
+	}
+	return added, deleted
+}
+
+/*
+* Self route for a destination string.  Called with the lock held.
+ */
+func (rm *RouteManager) findSelfDest(dest string) *SelfRoute {
+
+	for i := range rm.selfRoutes {
+		if IPNetToCidr(rm.selfRoutes[i].Dst) == dest {
+			return &rm.selfRoutes[i]
+		}
+	}
+	return nil
+}
+
+/*
+* How many destinations does the gateway host offer us?
+ */
+func (rm *RouteManager) ClaimCount(owner string) int {
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	n := 0
+	for _, owners := range rm.claims {
+		if _, ok := owners[owner]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+* Gateway hosts standing by for dest, besides the installed next hops.
+ */
+func (rm *RouteManager) Standby(dest string, installed []Hop) []string {
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	names := []string{}
+	for o := range rm.claims[dest] {
+		used := false
+		for _, h := range installed {
+			used = used || h.Owner == o
+		}
+		if !used {
+			names = append(names, o)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+* Drop claims whose lease ran out and settle their destinations.  Returns
+* the owners that lost claims.
+ */
+func (rm *RouteManager) ExpireLeases() []string {
+
+	rm.syncMutex.Lock()
+	defer rm.syncMutex.Unlock()
+
+	now := time.Now()
+	touched := []string{}
+	lost := []string{}
+
+	rm.mutex.Lock()
+	for dest, owners := range rm.claims {
+		for o, claim := range owners {
+			if claim.Expires.IsZero() || now.Before(claim.Expires) {
+				continue
+			}
+			slog.Warn("route lease expired", "dst", dest, "owner", o,
+				"gw", claim.Gateway)
+			delete(owners, o)
+			touched = append(touched, dest)
+			if !slices.Contains(lost, o) {
+				lost = append(lost, o)
+			}
+		}
+		if len(owners) == 0 {
+			delete(rm.claims, dest)
+		}
+	}
+	rm.mutex.Unlock()
+
+	for _, dest := range touched {
+		rm.settle(dest)
+	}
+	sort.Strings(lost)
+	return lost
+}
+
+/*
+* When the owner's claim on dest lapses, zero if it is not leased.
+ */
+func (rm *RouteManager) LeaseExpiry(dest string, owner string) time.Time {
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	return rm.claims[dest][owner].Expires
+}
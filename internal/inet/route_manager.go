@@ -5,7 +5,8 @@ package inet
 * learnedUpdates will typically be on the gateway host.
 *
 * selfRoutes are routes added by the route manager.  This sort route should
-* exist on the 'client' hosts
+* exist on the 'client' hosts.  Each belongs to the gateway host that
+* announced it.
  */
 import (
 	"fmt"
@@ -13,20 +14,31 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/consts"
+	"github.com/code-ointment/link-share/internal/events"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
 
 type RouteManager struct {
 	ifm            *InterfaceManager
-	learnedUpdates []RouteUpdate   // Routes we learned from the kernel
-	selfRoutes     []netlink.Route // Routes the manager was asked to add
+	role           consts.Role
+	learnedUpdates []RouteUpdate // Routes we learned from the kernel
+	selfRoutes     []SelfRoute   // Routes the manager was asked to add
 
-	mutex   sync.Mutex
-	updated chan struct{}
+	mutex sync.Mutex
+	bus   *events.Bus
+
+	// Destination to owner to claim, every gateway host offering a route.
+	// The installed self route belongs to one of them.
+	claims    map[string]map[string]Claim
+	chooser   Chooser
+	spreader  Spreader
+	syncMutex sync.Mutex // one SyncRoutes at a time
 
 	routingEnabled int
 	nfu            *NftUtil
@@ -40,11 +52,36 @@ type RouteUpdate struct {
 	Ifname string
 }
 
-func NewRouteManager(manager *InterfaceManager) *RouteManager {
+/*
+* A route we added and the gateway host it came from.  Multipath routes go
+* through several, Owner is then the first of Hops.
+ */
+type SelfRoute struct {
+	netlink.Route
+	Owner string
+	Hops  []Hop
+}
+
+/*
+* One gateway a route goes through.  Weight only matters for multipath
+* routes.
+ */
+type Hop struct {
+	Owner   string
+	Gateway string
+	Weight  int
+	MTU     int // path MTU through the gateway, 0 when unknown
+}
+
+func NewRouteManager(manager *InterfaceManager, role consts.Role,
+	bus *events.Bus) *RouteManager {
 
 	rm := RouteManager{
 		ifm:     manager,
-		updated: make(chan struct{}),
+		role:    role,
+		bus:     bus,
+		claims:  map[string]map[string]Claim{},
+		chooser: stickyChooser,
 	}
 
 	l := rm.ifm.GetDefaultLink()
@@ -54,7 +91,10 @@ func NewRouteManager(manager *InterfaceManager) *RouteManager {
 	_, rm.def6Net, _ = net.ParseCIDR("::/0")
 	_, rm.def4Net, _ = net.ParseCIDR("0.0.0.0/0")
 
-	rm.initLearnedUpdates()
+	// Clients never share their own tunnels.
+	if rm.role != consts.ROLE_CLIENT {
+		rm.initLearnedUpdates()
+	}
 	return &rm
 
 }
@@ -67,20 +107,26 @@ func (rm *RouteManager) Start() {
 }
 
 /*
-* Turn host routing on and off
+* Turn host routing on and off.  A client never touches sysctl or nftables.
+* Caller holds rm.mutex.
  */
-func (rm *RouteManager) EnableRouting() {
+func (rm *RouteManager) enableRouting() {
 
 	if rm.routingEnabled == 1 {
 		return
 	}
 
+	if rm.role == consts.ROLE_CLIENT {
+		slog.Warn("client role, not enabling routing")
+		return
+	}
+
 	rm.routingEnabled = 1
 	rm.setRouting(rm.routingEnabled)
 	rm.nfu.EnableForwarding()
 }
 
-func (rm *RouteManager) DisableRouting() {
+func (rm *RouteManager) disableRouting() {
 
 	if rm.routingEnabled == 0 {
 		return
@@ -100,6 +146,9 @@ func (rm *RouteManager) setRouting(onoff int) {
 		"/proc/sys/net/ipv6/conf/all/forwarding"}
 
 	for _, fname := range ctl {
+		if dryRun("write sysctl", "fname", fname, "value", v) {
+			continue
+		}
 		fd, err := os.OpenFile(fname, os.O_RDWR, 0644)
 		if err != nil {
 			slog.Warn("error opening", "fname", fname, "error", err)
@@ -115,6 +164,19 @@ func (rm *RouteManager) setRouting(onoff int) {
  */
 func (rm *RouteManager) routeMonitor() {
 
+	for {
+		rm.watchRoutes()
+		slog.Warn("route subscription lost, resubscribing")
+		time.Sleep(time.Second)
+	}
+}
+
+/*
+* Read route updates until netlink closes the channel, which it does when
+* the socket overflows during a large burst of changes.
+ */
+func (rm *RouteManager) watchRoutes() {
+
 	ch := make(chan netlink.RouteUpdate)
 	done := make(chan struct{})
 	defer close(done)
@@ -126,9 +188,16 @@ func (rm *RouteManager) routeMonitor() {
 	}
 
 	for {
-		ru := <-ch
+		ru, ok := <-ch
+		if !ok {
+			return
+		}
 
 		slog.Debug("channel read", "ru", ru)
+		if rm.role == consts.ROLE_CLIENT || ru.Dst == nil {
+			continue
+		}
+
 		// Don't advertise routes we inserted.
 		if rm.findSelfRouteLocked(ru.Dst) != nil {
 			slog.Debug("own route, not announced")
@@ -138,24 +207,18 @@ func (rm *RouteManager) routeMonitor() {
 		if rm.classifyUpdate(&ru) {
 			l := rm.ifm.GetLinkByIndex(ru.LinkIndex)
 			rm.updateLearned(ru.Type, ru.Route.Dst, l.Attrs().Name)
-			rm.routesReady()
+			rm.routesReady(ru.Type, ru.Route.Dst, l.Attrs().Name)
 		}
 	}
 }
 
 /*
-* Make sure interface name is a tunnel device.
+* Make sure interface name is a tunnel device.  Patterns come from the
+* tunnels section of the configuration.
 * TODO: Do we need to do this or are RawFlags enough?
  */
 func (rm *RouteManager) qualifyLinkName(link netlink.Link) bool {
-
-	ifnames := []string{"gpd", "tun"}
-	for _, n := range ifnames {
-		if strings.Contains(link.Attrs().Name, n) {
-			return true
-		}
-	}
-	return false
+	return config.Get().TunnelName(link.Attrs().Name)
 }
 
 /*
@@ -250,6 +313,12 @@ func (rm *RouteManager) classifyUpdate(ru *netlink.RouteUpdate) bool {
 		return false
 	}
 
+	// Configured prefix filters
+	if !config.Get().Prefixes.Allowed(ru.Dst) {
+		slog.Debug("prefix filtered", "dst", IPNetToCidr(ru.Dst))
+		return false
+	}
+
 	// If this is a route using a tunnel device...
 	return rm.IsTunnelRoute(ru)
 }
@@ -301,14 +370,14 @@ func (rm *RouteManager) updateLearned(op uint16, dst *net.IPNet, intf string) {
 			!rm.netEqual(rm.def4Net, dst) &&
 			!rm.netEqual(rm.def6Net, dst) {
 			rm.learnedUpdates = append(rm.learnedUpdates, ru)
-			rm.EnableRouting()
+			rm.enableRouting()
 		}
 	} else {
 		for _, m := range matches {
 			m.Op = op
 		}
 		if op == unix.RTM_DELROUTE {
-			rm.DisableRouting() // TODO: Support multiple gw interfaces.
+			rm.disableRouting() // TODO: Support multiple gw interfaces.
 		}
 	}
 
@@ -336,20 +405,47 @@ func (rm *RouteManager) GetRouteUpdates() []RouteUpdate {
 }
 
 /*
-* Alert anyone listening on the update channel.  The idea here is to write to
-* the channel without blocking the caller.
+* Copy of the routes this manager added to the kernel.
  */
-func (rm *RouteManager) routesReady() {
-	go func() {
-		rm.updated <- struct{}{}
-	}()
+func (rm *RouteManager) GetSelfRoutes() []SelfRoute {
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	r := []SelfRoute{}
+	r = append(r, rm.selfRoutes...)
+	return r
 }
 
 /*
-* Wait for update to show up on the update channel.
+* Is forwarding and NAT turned on?
  */
-func (rm *RouteManager) WaitForUpdate() {
-	<-rm.updated
+func (rm *RouteManager) RoutingEnabled() bool {
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	return rm.routingEnabled == 1
+}
+
+func (rm *RouteManager) GetNftUtil() *NftUtil {
+	return rm.nfu
+}
+
+/*
+* Publish a learned route change.  Never blocks the monitor.
+ */
+func (rm *RouteManager) routesReady(op uint16, dst *net.IPNet, ifname string) {
+
+	kind := events.RouteLearned
+	if op == unix.RTM_DELROUTE {
+		kind = events.RouteWithdrawn
+	}
+	rm.bus.Publish(events.Event{
+		Kind: kind,
+		Name: IPNetToCidr(dst),
+		Link: ifname,
+	})
 }
 
 func (rm *RouteManager) GetDefaultLink() netlink.Link {
@@ -372,13 +468,13 @@ func (rm *RouteManager) GetDefaultLink() netlink.Link {
 }
 
 /*
-* Look for the destination that were added via rm.AddRoute
+* Look for the destination that were added via rm.installRoute
  */
 func (rm *RouteManager) findSelfRoute(dst *net.IPNet) *netlink.Route {
 
 	for _, rt := range rm.selfRoutes {
 		if rm.netEqual(dst, rt.Dst) {
-			return &rt
+			return &rt.Route
 		}
 	}
 	return nil
@@ -396,9 +492,9 @@ func (rm *RouteManager) findSelfRouteLocked(dst *net.IPNet) *netlink.Route {
 }
 
 /*
-* Add a route to the kernel.
+* Install dest through one gateway, or several as a multipath route.
  */
-func (rm *RouteManager) AddRoute(dest string, gateway string) bool {
+func (rm *RouteManager) installRoute(dest string, hops []Hop, replace bool) bool {
 
 	rm.mutex.Lock()
 	defer rm.mutex.Unlock()
@@ -409,32 +505,90 @@ func (rm *RouteManager) AddRoute(dest string, gateway string) bool {
 		return false
 	}
 
-	if rm.findSelfRoute(dst) != nil {
+	if !replace && rm.findSelfRoute(dst) != nil {
 		slog.Info("route exists, skipping", "route", dest)
 		return false
 	}
 
-	// Look up the route to the gateway.
+	// Look up the route to each gateway.
 	// We will need the LinkIndex for this route in a moment.
-	gw := net.ParseIP(gateway)
-	gwrt, err := netlink.RouteGet(gw)
-	if err != nil {
-		slog.Warn("route lookup failure", "error", err)
-		return false
+	rt := netlink.Route{Dst: dst}
+	for _, h := range hops {
+
+		gw := net.ParseIP(h.Gateway)
+		gwrt, err := netlink.RouteGet(gw)
+		if err != nil {
+			slog.Warn("route lookup failure", "error", err)
+			return false
+		}
+		if len(gwrt) == 0 {
+			slog.Warn("No route found to gateway", "addr", h.Gateway)
+			return false
+		}
+
+		if len(hops) == 1 {
+			rt.LinkIndex = gwrt[0].LinkIndex
+			rt.Gw = gw
+			break
+		}
+
+		// Kernel weights count from 0.
+		weight := h.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		rt.MultiPath = append(rt.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: gwrt[0].LinkIndex,
+			Gw:        gw,
+			Hops:      weight - 1,
+		})
+	}
+	setMTU(&rt, hops)
+	sr := SelfRoute{Route: rt, Owner: hops[0].Owner, Hops: hops}
+
+	action := "route add"
+	apply := netlink.RouteAdd
+	if replace {
+		action = "route replace"
+		apply = netlink.RouteReplace
 	}
 
-	if len(gwrt) > 0 {
-		rt := netlink.Route{LinkIndex: gwrt[0].LinkIndex, Dst: dst, Gw: gw}
-		if err := netlink.RouteAdd(&rt); err != nil {
-			slog.Warn("error adding route", "error", err)
+	if !dryRun(action, "dst", dest, "via", hopsString(hops), "mtu", rt.MTU) {
+		if err := apply(&rt); err != nil {
+			slog.Warn("error adding route", "dst", dest, "error", err)
 			return false
 		}
-		rm.selfRoutes = append(rm.selfRoutes, rt)
-		return true
-	} else {
-		slog.Warn("No route found to gateway", "addr", gateway)
-		return false
 	}
+
+	rm.delSelfRoute(dst)
+	rm.selfRoutes = append(rm.selfRoutes, sr)
+	return true
+}
+
+/*
+* Limit the route to the smallest MTU of its next hops, advertising a TCP
+* MSS that fits, so connections never depend on path MTU discovery through
+* the tunnel.
+ */
+func setMTU(rt *netlink.Route, hops []Hop) {
+
+	mtu := 0
+	for _, h := range hops {
+		if h.MTU > 0 && (mtu == 0 || h.MTU < mtu) {
+			mtu = h.MTU
+		}
+	}
+	if mtu == 0 {
+		return
+	}
+
+	// IP and TCP headers.
+	overhead := 40
+	if rt.Dst.IP.To4() == nil {
+		overhead = 60
+	}
+	rt.MTU = mtu
+	rt.AdvMSS = mtu - overhead
 }
 
 /*
@@ -457,6 +611,10 @@ func (rm *RouteManager) DeleteRoute(dest string, gateway string) bool {
 		return false
 	}
 
+	if dryRun("route del", "dst", dest, "gw", gateway) {
+		rm.delSelfRoute(dst)
+		return true
+	}
 	if err := netlink.RouteDel(rt); err != nil {
 		slog.Warn("error deleting route", "error", err)
 		return false
@@ -474,7 +632,7 @@ func (rm *RouteManager) delSelfRoute(dst *net.IPNet) *netlink.Route {
 	for i, rt := range rm.selfRoutes {
 		if rm.netEqual(dst, rt.Dst) {
 			rm.selfRoutes = append(rm.selfRoutes[:i], rm.selfRoutes[i+1:]...)
-			return &rt
+			return &rt.Route
 		}
 	}
 	return nil
@@ -489,7 +647,11 @@ func (rm *RouteManager) DropSelfRoutes() {
 	defer rm.mutex.Unlock()
 
 	for _, rt := range rm.selfRoutes {
-		netlink.RouteDel(&rt)
+		if dryRun("route del", "dst", IPNetToCidr(rt.Dst), "gw", rt.Gw) {
+			continue
+		}
+		netlink.RouteDel(&rt.Route)
 	}
-	rm.selfRoutes = []netlink.Route{}
+	rm.selfRoutes = []SelfRoute{}
+	rm.claims = map[string]map[string]Claim{}
 }
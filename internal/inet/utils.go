@@ -2,8 +2,10 @@ package inet
 
 import (
 	"fmt"
+	"log/slog"
 	"net"
 
+	"github.com/code-ointment/link-share/internal/config"
 	"golang.org/x/sys/unix"
 )
 
@@ -34,6 +36,19 @@ func AddrToIP(addr net.Addr) net.IP {
 	return net.IP{}
 }
 
+/*
+* In dry run mode log the change the caller intends to make and return true
+* so the caller skips it.
+ */
+func dryRun(action string, args ...any) bool {
+
+	if !config.Get().DryRun {
+		return false
+	}
+	slog.Info("dry-run: "+action, args...)
+	return true
+}
+
 /*
 * Return net as a cidr string.
  */
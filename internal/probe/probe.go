@@ -0,0 +1,334 @@
+package probe
+
+/*
+* Reachability probes through the tunnel.  A tunnel interface can stay up
+* while the VPN session behind it is dead, so gateways check they can still
+* reach hosts on the other side.  Every interval each target gets an ICMP
+* echo or a TCP connect, bound to the tunnel so a probe never passes by
+* going another way.  A round passes when any target answers, so one host
+* going away doesn't take the tunnel with it.  After failures failed
+* rounds in a row the tunnel is unhealthy, after successes good rounds it is
+* healthy again.
+ */
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/code-ointment/link-share/internal/config"
+	"github.com/code-ointment/link-share/internal/inet"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	TypeICMP string = "icmp"
+	TypeTCP  string = "tcp"
+)
+
+/*
+* Latest outcome for one target.
+ */
+type Result struct {
+	Type     string
+	Target   string
+	Ok       bool
+	Rtt      time.Duration
+	Error    string
+	Checked  time.Time
+	Failures int // in a row
+}
+
+type Prober struct {
+	mutex    sync.Mutex
+	ifm      *inet.InterfaceManager
+	probes   []config.Probe
+	interval time.Duration
+	timeout  time.Duration
+	fall     int
+	rise     int
+	results  []Result
+	healthy  bool
+	failed   int // rounds in a row
+	passed   int
+	changes  chan bool
+	echoID   int
+	echoSeq  atomic.Uint32
+}
+
+func NewProber(ifm *inet.InterfaceManager) *Prober {
+
+	cfg := config.Get().Health
+	p := Prober{
+		ifm:      ifm,
+		probes:   cfg.Probes,
+		interval: cfg.Interval,
+		timeout:  cfg.Timeout,
+		fall:     cfg.Failures,
+		rise:     cfg.Successes,
+		healthy:  true,
+		changes:  make(chan bool, 4),
+		echoID:   os.Getpid() & 0xffff,
+	}
+	for _, pr := range cfg.Probes {
+		p.results = append(p.results, Result{Type: pr.Type, Target: pr.Target})
+	}
+	return &p
+}
+
+/*
+* Launch the probe thread.  The tunnel counts as healthy until the probes
+* say otherwise.
+ */
+func (p *Prober) Start() {
+
+	slog.Info("tunnel probes started", "targets", len(p.probes),
+		"interval", p.interval)
+	go p.run()
+}
+
+func (p *Prober) run() {
+
+	for {
+		p.round()
+		time.Sleep(p.interval)
+	}
+}
+
+/*
+* Probe every target at once and judge the round.
+ */
+func (p *Prober) round() {
+
+	tunnel := p.tunnel()
+	results := make([]Result, len(p.probes))
+	var wg sync.WaitGroup
+	for i, pr := range p.probes {
+		wg.Add(1)
+		go func(i int, pr config.Probe) {
+			defer wg.Done()
+			results[i] = p.check(pr, tunnel)
+		}(i, pr)
+	}
+	wg.Wait()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ok := false
+	for i, r := range results {
+		if r.Ok {
+			ok = true
+		} else {
+			r.Failures = p.results[i].Failures + 1
+			slog.Debug("probe failed", "type", r.Type, "target", r.Target,
+				"failures", r.Failures, "error", r.Error)
+		}
+		p.results[i] = r
+	}
+
+	if ok {
+		p.passed++
+		p.failed = 0
+	} else {
+		p.failed++
+		p.passed = 0
+	}
+
+	if p.healthy && p.failed >= p.fall {
+		p.healthy = false
+		slog.Warn("tunnel probes failing", "rounds", p.failed)
+		p.notify(false)
+	} else if !p.healthy && p.passed >= p.rise {
+		p.healthy = true
+		slog.Info("tunnel probes passing again", "rounds", p.passed)
+		p.notify(true)
+	}
+}
+
+/*
+* Probes go out of the first tunnel that is up, "" when none is.
+ */
+func (p *Prober) tunnel() string {
+
+	for _, t := range p.ifm.GetTunnels() {
+		if p.ifm.IsUp(t) {
+			return t.Attrs().Name
+		}
+	}
+	return ""
+}
+
+func (p *Prober) check(pr config.Probe, tunnel string) Result {
+
+	r := Result{Type: pr.Type, Target: pr.Target, Checked: time.Now()}
+
+	var err error
+	switch {
+	case tunnel == "":
+		err = errors.New("no tunnel up")
+	case pr.Type == TypeICMP:
+		r.Rtt, err = p.ping(pr.Target, tunnel)
+	case pr.Type == TypeTCP:
+		r.Rtt, err = p.connect(pr.Target, tunnel)
+	default:
+		err = fmt.Errorf("unknown probe type %q", pr.Type)
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Ok = true
+	return r
+}
+
+/*
+* Socket option control binding a socket to the tunnel.
+ */
+func bindTo(tunnel string) func(string, string, syscall.RawConn) error {
+
+	return func(network string, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), tunnel)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+/*
+* ICMP echo, waiting for the matching reply.
+ */
+func (p *Prober) ping(target string, tunnel string) (time.Duration, error) {
+
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return 0, fmt.Errorf("bad address %q", target)
+	}
+
+	network, laddr, proto := "ip4:icmp", "0.0.0.0", 1
+	var echo, reply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, laddr, proto = "ip6:ipv6-icmp", "::", 58
+		echo, reply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	lc := net.ListenConfig{Control: bindTo(tunnel)}
+	c, err := lc.ListenPacket(context.Background(), network, laddr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	seq := int(p.echoSeq.Add(1) & 0xffff)
+	msg := icmp.Message{
+		Type: echo,
+		Body: &icmp.Echo{ID: p.echoID, Seq: seq, Data: []byte("link-share")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	c.SetReadDeadline(start.Add(p.timeout))
+	if _, err := c.WriteTo(b, &net.IPAddr{IP: ip}); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return 0, errors.New("no reply")
+			}
+			return 0, err
+		}
+
+		// Every ICMP packet arrives on a raw socket, find ours.
+		rm, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || rm.Type != reply {
+			continue
+		}
+		body, ok := rm.Body.(*icmp.Echo)
+		if !ok || body.ID != p.echoID || body.Seq != seq {
+			continue
+		}
+		if pa, ok := peer.(*net.IPAddr); !ok || !pa.IP.Equal(ip) {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+/*
+* TCP connect, closed at once.  A refused connection counts as reachable,
+* the reset came back through the tunnel even if the service is down.
+ */
+func (p *Prober) connect(target string, tunnel string) (time.Duration, error) {
+
+	d := net.Dialer{Timeout: p.timeout, Control: bindTo(tunnel)}
+	start := time.Now()
+	c, err := d.Dial("tcp", target)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		slog.Debug("probe connection refused, tunnel reachable",
+			"target", target)
+		return time.Since(start), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	c.Close()
+	return time.Since(start), nil
+}
+
+/*
+* Tell whoever reads Changes.  Never blocks, a reader that falls behind
+* loses changes.  Called with the object lock held.
+ */
+func (p *Prober) notify(healthy bool) {
+
+	select {
+	case p.changes <- healthy:
+	default:
+		slog.Warn("probe change dropped", "healthy", healthy)
+	}
+}
+
+/*
+* Health changes, true when the tunnel is healthy again.
+ */
+func (p *Prober) Changes() <-chan bool {
+	return p.changes
+}
+
+func (p *Prober) Healthy() bool {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.healthy
+}
+
+func (p *Prober) Results() []Result {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	results := make([]Result, len(p.results))
+	copy(results, p.results)
+	return results
+}
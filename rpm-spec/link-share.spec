@@ -38,10 +38,12 @@ mkdir -p $RPM_BUILD_ROOT/opt/code-ointment/link-share/bin
 mkdir -p $RPM_BUILD_ROOT/opt/code-ointment/link-share/etc
 
 cp $RPM_BUILD_DIR/bin/link-share $RPM_BUILD_ROOT/opt/code-ointment/link-share/bin
+cp $RPM_BUILD_DIR/bin/link-sharectl $RPM_BUILD_ROOT/opt/code-ointment/link-share/bin
 cp $RPM_BUILD_DIR/scripts/link-share.sh $RPM_BUILD_ROOT/opt/code-ointment/link-share/bin
 chmod 755 $RPM_BUILD_ROOT/opt/code-ointment/link-share/bin/link-share.sh
 
 cp $RPM_BUILD_DIR/etc/link-share.service $RPM_BUILD_ROOT/opt/code-ointment/link-share/etc
+cp $RPM_BUILD_DIR/etc/link-share.yaml $RPM_BUILD_ROOT/opt/code-ointment/link-share/etc
 
 %clean
 rm -rf $RPM_BUILD_ROOT
@@ -52,8 +54,10 @@ rm -rf $RPM_BUILD_ROOT
   %dir /opt/code-ointment/link-share/etc
   %dir /var/log/code-ointment/link-share
   /opt/code-ointment/link-share/bin/link-share
+  /opt/code-ointment/link-share/bin/link-sharectl
   /opt/code-ointment/link-share/bin/link-share.sh
   /opt/code-ointment/link-share/etc/link-share.service
+  /opt/code-ointment/link-share/etc/link-share.yaml
 
 %pre
 # Stuff that needs to execute just before package is to be installed
@@ -22,12 +22,22 @@ if [ ! -z "$1" ] ; then
 fi
 PIDFILE=/var/tmp/link-share.pid
 
+# Local configuration wins over the copy shipped with the package.
+CONFIG=/etc/link-share/link-share.yaml
+if [ ! -f $CONFIG ] ; then
+    CONFIG=$homepath/etc/link-share.yaml
+fi
+
 STDOUT=/var/log/code-ointment/link-share/link-share.stdout
 STDERR=/var/log/code-ointment/link-share/link-share.stderr
 
 if [ $cmd = "start" ]; then
-    exec $homepath/bin/link-share > $STDOUT 2>$STDERR
+    exec $homepath/bin/link-share -config $CONFIG > $STDOUT 2>$STDERR
 elif [ $cmd = "stop" ]; then
+    # Ask nicely over the control socket first.
+    if $homepath/bin/link-sharectl stop > /dev/null 2>&1 ; then
+        exit 0
+    fi
     if [ ! -f $PIDFILE  ] ; then
         echo "Missing pid file, shutdown by hand please"
         exit 1